@@ -3,14 +3,19 @@ package awt
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os/exec"
 	"runtime"
+	"sync"
 	"time"
 )
 
+// Shortest step tc is changed for (in milliseconds), every step runs tc on all the interfaces
+const LIMITER_MIN_STEP_MS = 200
+
 type Trajectory struct {
 	Speed    int64  `json:"speed"`
 	Duration uint64 `json:"duration"`
@@ -32,9 +37,12 @@ func (r *BandwidthReport) Encode() (buf []byte, err error) {
 type BandwidthLimiter struct {
 	CurrentBandwidth  int64
 	CurrentTrajectory []Trajectory
-	DoAbort           bool
 	DefaultLatency    uint64
 	NetworkInterfaces []net.Interface
+	// Closed to stop the trajectory being played
+	abort chan struct{}
+
+	lock *sync.Mutex
 }
 
 func NewBandwidthLimiter() (l *BandwidthLimiter, err error) {
@@ -56,62 +64,108 @@ func NewBandwidthLimiter() (l *BandwidthLimiter, err error) {
 		CurrentBandwidth:  -1,
 		DefaultLatency:    50,
 		NetworkInterfaces: iFaces,
+		lock:              new(sync.Mutex),
 	}
 	return
 }
 
+// Steps shorter than LIMITER_MIN_STEP_MS (except 0, until changed) and looping forever are NOT allowed, the
+// host is changed with tc on every step
+func (l *BandwidthLimiter) ValidateTrajectory(trajectory []Trajectory, loops int) error {
+	if len(trajectory) <= 0 {
+		return errors.New("Empty trajectory")
+	}
+	if loops < 0 {
+		return errors.New("The host limiter can NOT loop forever")
+	}
+	for i, step := range trajectory {
+		if step.Duration > 0 && step.Duration < LIMITER_MIN_STEP_MS {
+			return errors.New(fmt.Sprintf("Step %d lasts %dms, the host limiter needs at least %dms", i, step.Duration, LIMITER_MIN_STEP_MS))
+		}
+	}
+	return nil
+}
+
 func (l *BandwidthLimiter) SetBandwidth(trajectory []Trajectory) {
+	l.PlayBandwidth(trajectory, 0)
+}
+
+// Plays the trajectory loops more times after the first one, it returns when finished or replaced by another one
+func (l *BandwidthLimiter) PlayBandwidth(trajectory []Trajectory, loops int) {
 	var (
 		err error
 	)
 
-	if len(trajectory) <= 0 {
-		log.Println("no trajectory was given")
+	if err = l.ValidateTrajectory(trajectory, loops); err != nil {
+		log.Printf("Error: %s\n", err)
 		return
 	}
 
+	// Stops the one being played
+	abort := make(chan struct{})
+	l.lock.Lock()
+	if l.abort != nil {
+		close(l.abort)
+	}
+	l.abort = abort
 	l.CurrentTrajectory = trajectory
+	l.lock.Unlock()
 
 	log.Println("limiting bandwidth...")
 
-	for _, step := range l.CurrentTrajectory {
-		var (
-			bandwidthStr string = fmt.Sprintf("%dkbit", step.Speed)
-			latencyStr   string
-			latency      uint64
-		)
-
-		if step.Latency <= 0 {
-			latency = l.DefaultLatency
-		} else {
-			latency = step.Latency
-		}
+	for loop := 0; loop <= loops; loop++ {
+		for _, step := range trajectory {
+			var (
+				bandwidthStr string = fmt.Sprintf("%dkbit", step.Speed)
+				latencyStr   string
+				latency      uint64
+			)
 
-		latencyStr = fmt.Sprintf("%dms", latency)
+			if step.Latency <= 0 {
+				latency = l.DefaultLatency
+			} else {
+				latency = step.Latency
+			}
 
-		l.CurrentBandwidth = step.Speed
+			latencyStr = fmt.Sprintf("%dms", latency)
 
-		if step.Duration <= 0 {
-			log.Printf("limiting to %s for eternity (or until changed)\n", bandwidthStr)
-		} else {
-			log.Printf("limiting to %s for the next %0.2fs\n", bandwidthStr, float64(step.Duration)/1_000)
-		}
+			if step.Duration <= 0 {
+				log.Printf("limiting to %s for eternity (or until changed)\n", bandwidthStr)
+			} else {
+				log.Printf("limiting to %s for the next %0.2fs\n", bandwidthStr, float64(step.Duration)/1_000)
+			}
 
-		if err = l.commandOnAllNetInterfaces(func(iface string) *exec.Cmd {
-			return exec.Command("tc", "qdisc", "add", "dev", iface, "root", "tbf", "rate", bandwidthStr, "latency", latencyStr, "burst", "1540")
-		}); err != nil {
-			log.Printf("Error: %s\n", err)
-			return
-		}
+			// Replace, so every step after the first one changes the existing qdisc. Under the lock, so an
+			// aborted trajectory can NOT change it after the abort
+			l.lock.Lock()
+			select {
+			case <-abort:
+				l.lock.Unlock()
+				log.Println("aborted")
+				return
+			default:
+			}
+			l.CurrentBandwidth = step.Speed
+			err = l.commandOnAllNetInterfaces(func(iface string) *exec.Cmd {
+				return exec.Command("tc", "qdisc", "replace", "dev", iface, "root", "tbf", "rate", bandwidthStr, "latency", latencyStr, "burst", "1540")
+			})
+			l.lock.Unlock()
+			if err != nil {
+				log.Printf("Error: %s\n", err)
+				return
+			}
 
-		for dur := 1; dur <= int(step.Duration/200); dur++ {
-			if !l.DoAbort {
-				time.Sleep(200 * time.Millisecond)
-			} else {
-				l.DeleteBandwidth()
-				l.DoAbort = false
+			if step.Duration <= 0 {
+				// Until changed
+				return
+			}
+			timer := time.NewTimer(time.Duration(step.Duration) * time.Millisecond)
+			select {
+			case <-abort:
+				timer.Stop()
 				log.Println("aborted")
 				return
+			case <-timer.C:
 			}
 		}
 	}
@@ -121,9 +175,13 @@ func (l *BandwidthLimiter) DeleteBandwidth() {
 	var (
 		err error
 	)
-	l.Abort()
 	log.Println("deleting bandwidth...")
 
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.abortLocked()
+	l.CurrentBandwidth = -1
 	if err = l.commandOnAllNetInterfaces(func(iface string) *exec.Cmd {
 		return exec.Command("tc", "qdisc", "delete", "dev", iface, "root")
 	}); err != nil {
@@ -132,12 +190,26 @@ func (l *BandwidthLimiter) DeleteBandwidth() {
 	}
 }
 
+// Stops the trajectory being played, the current limit is kept
 func (l *BandwidthLimiter) Abort() {
-	log.Println("aborting...")
-	l.DoAbort = true
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.abortLocked()
+}
+
+func (l *BandwidthLimiter) abortLocked() {
+	if l.abort != nil {
+		log.Println("aborting...")
+		close(l.abort)
+		l.abort = nil
+	}
 }
 
 func (l *BandwidthLimiter) GetCurrentBandwidth() BandwidthReport {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
 	return BandwidthReport{
 		CurrentBandwidth: l.CurrentBandwidth,
 	}
@@ -1,13 +1,29 @@
 package awt
 
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+)
+
 type EncoderQuality struct {
-	Bitrate    uint64
-	Resolution string
-	MaxRate    uint64
-	BufSize    uint64
+	Bitrate    uint64 `json:"bitrate"`
+	Resolution string `json:"resolution,omitempty"`
+	MaxRate    uint64 `json:"max_rate,omitempty"`
+	BufSize    uint64 `json:"buf_size,omitempty"`
+
+	// Source rendition, forwarded as it arrives (never transformed)
+	Passthrough bool `json:"passthrough,omitempty"`
 }
 
-var EncoderSettings []EncoderQuality = []EncoderQuality{
+// Renditions of a track, ascending bitrates, one of them is the source (Passthrough)
+type EncoderLadder []EncoderQuality
+
+// Default ladder
+var EncoderSettings EncoderLadder = EncoderLadder{
 	{
 		Bitrate:    100,
 		Resolution: "256x144",
@@ -21,47 +37,75 @@ var EncoderSettings []EncoderQuality = []EncoderQuality{
 		BufSize:    750,
 	},
 	{
-		Bitrate:    1_000,
-		Resolution: "1920x1080",
-		MaxRate:    1_000,
-		BufSize:    1_500,
+		Bitrate:     1_000,
+		Resolution:  "1920x1080",
+		MaxRate:     1_000,
+		BufSize:     1_500,
+		Passthrough: true,
 	},
 }
 
-func Encode(chunk []byte, quality EncoderQuality) (eChunk []byte, err error) {
-	// var (
-	// 	input          *bytes.Buffer = bytes.NewBuffer(chunk)
-	// 	output, errOut bytes.Buffer
-	// 	// TODO if laptops allow it, maybe inscribe video with resolution and bitrate
-	// 	command *exec.Cmd = exec.Command(
-	// 		"ffmpeg",
-	// 		"-i", "pipe:0",
-	// 		"-preset", "ultrafast",
-	// 		"-c", "copy",
-	// 		"-f", "matroska",
-	// 		"-vf", quality.Resolution,
-	// 		"-b:v", fmt.Sprintf("%dk", quality.Bitrate),
-	// 		"-an",
-	// 		"-maxrate", fmt.Sprintf("%dk", quality.MaxRate),
-	// 		"-bufsize", fmt.Sprintf("%dk", quality.BufSize),
-	// 		"pipe:1",
-	// 	)
-	// )
+// Only video needs a transformed rendition, the rest is forwarded as it arrives
+func NeedsEncode(mediaType string, quality EncoderQuality) bool {
+	return mediaType == "video" && !quality.Passthrough
+}
+
+// Sorts the ladder by bitrate and checks there is exactly one source and bitrates are unique
+func (l EncoderLadder) Validate() error {
+	if len(l) <= 0 {
+		return errors.New("Empty ladder")
+	}
+	slices.SortFunc(l, func(a EncoderQuality, b EncoderQuality) int {
+		return cmp.Compare(a.Bitrate, b.Bitrate)
+	})
 
-	// command.Stdin = input
-	// command.Stdout = &output
-	// command.Stderr = &errOut
+	numSources := 0
+	for i, quality := range l {
+		if i > 0 && l[i-1].Bitrate == quality.Bitrate {
+			return errors.New(fmt.Sprintf("Repeated bitrate %d in ladder", quality.Bitrate))
+		}
+		if quality.Passthrough {
+			numSources++
+		}
+	}
+	if numSources != 1 {
+		return errors.New(fmt.Sprintf("Ladder needs exactly one passthrough quality, found %d", numSources))
+	}
+	return nil
+}
 
-	// if err = command.Run(); err != nil {
-	// 	return
-	// }
+func (l EncoderLadder) Bitrates() []uint64 {
+	bitrates := make([]uint64, len(l))
+	for i, quality := range l {
+		bitrates[i] = quality.Bitrate
+	}
+	return bitrates
+}
 
-	// // TODO check input len and output len
+// Rendition that holds the payload as received from the publisher
+func (l EncoderLadder) Source() EncoderQuality {
+	for _, quality := range l {
+		if quality.Passthrough {
+			return quality
+		}
+	}
+	return l[len(l)-1]
+}
 
-	// fmt.Printf("Err: %s\n", errOut.String())
-	// eChunk = output.Bytes()
-	eChunk = make([]byte, len(chunk))
-	copy(eChunk, chunk)
+// Gets the ladder of a track
+type LadderProvider func(trackNamespace string, trackName string) EncoderLadder
+
+// Qualities available for a track, so players know what they can get
+type LadderReport struct {
+	Namespace string        `json:"namespace"`
+	Track     string        `json:"track"`
+	Qualities EncoderLadder `json:"qualities"`
+}
 
+func (r *LadderReport) Encode() (buf []byte, err error) {
+	if buf, err = json.Marshal(r); err != nil {
+		log.Printf("Error: %s\n", err)
+		return
+	}
 	return
 }
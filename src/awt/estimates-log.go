@@ -0,0 +1,102 @@
+package awt
+
+import (
+	"encoding/csv"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var estimatesLogHeader = []string{"time_ms", "connection", "estimator", "kbps", "rtt_ms", "cwnd", "bytes_in_flight"}
+
+// Rows waiting to be written, more are dropped (Write is called from the packet tracer, it can NOT block)
+const ESTIMATES_LOG_QUEUE_SIZE = 1024
+
+// CSV with the estimate of every estimator each time a stream is finished, so they can be compared on the same trace.
+// Rows are written by its own goroutine
+type EstimatesLog struct {
+	fp     *os.File
+	writer *csv.Writer
+	rows   chan [][]string
+	done   chan struct{}
+	closed bool
+
+	lock *sync.Mutex
+}
+
+// Appends to the file if it exists
+func NewEstimatesLog(path string) (l *EstimatesLog, err error) {
+	var (
+		fp   *os.File
+		info os.FileInfo
+	)
+	if fp, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return
+	}
+	if info, err = fp.Stat(); err != nil {
+		fp.Close()
+		return
+	}
+
+	l = &EstimatesLog{fp: fp, writer: csv.NewWriter(fp), rows: make(chan [][]string, ESTIMATES_LOG_QUEUE_SIZE), done: make(chan struct{}), lock: new(sync.Mutex)}
+	if info.Size() <= 0 {
+		l.writer.Write(estimatesLogHeader)
+		l.writer.Flush()
+	}
+	go l.writeRows()
+	return
+}
+
+// Queues the rows, it does NOT do any I/O
+func (l *EstimatesLog) Write(now time.Time, connection uint64, estimators []ThroughputEstimator, rtt time.Duration, cwnd uint64, bytesInFlight uint64) {
+	rows := make([][]string, 0, len(estimators))
+	for _, estimator := range estimators {
+		rows = append(rows, []string{
+			strconv.FormatInt(now.UnixMilli(), 10),
+			strconv.FormatUint(connection, 10),
+			estimator.Name(),
+			strconv.FormatUint(estimator.Estimate(), 10),
+			strconv.FormatFloat(float64(rtt)/float64(time.Millisecond), 'f', 3, 64),
+			strconv.FormatUint(cwnd, 10),
+			strconv.FormatUint(bytesInFlight, 10),
+		})
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return
+	}
+	select {
+	case l.rows <- rows:
+	default:
+		log.Printf("Error: estimates log queue full, dropping %d rows\n", len(rows))
+	}
+}
+
+func (l *EstimatesLog) writeRows() {
+	defer close(l.done)
+
+	for rows := range l.rows {
+		l.writer.WriteAll(rows)
+		if err := l.writer.Error(); err != nil {
+			log.Printf("Error: %s\n", err)
+		}
+	}
+}
+
+// Writes the queued rows
+func (l *EstimatesLog) Close() error {
+	l.lock.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.rows)
+	}
+	l.lock.Unlock()
+
+	<-l.done
+	return l.fp.Close()
+}
@@ -16,7 +16,29 @@ func Cors(fs http.Handler) http.HandlerFunc {
 	}
 }
 
-func ServeHTTP(staticDir string) {
+// Host wide limiter (tc) or shaper of a session
+type BandwidthController interface {
+	// Error if the trajectory can NOT be played (checked before playing it in the background)
+	ValidateTrajectory(trajectory []Trajectory, loops int) error
+	SetBandwidth(trajectory []Trajectory)
+	PlayBandwidth(trajectory []Trajectory, loops int)
+	DeleteBandwidth()
+	GetCurrentBandwidth() BandwidthReport
+}
+
+// Shaper of the session in the query (?session=<session name>), the host wide limiter without it (if available)
+func bandwidthController(r *http.Request, limiter *BandwidthLimiter, shapers *ShaperRegistry) (BandwidthController, bool) {
+	session := r.URL.Query().Get("session")
+	if session != "" {
+		return shapers.Get(session)
+	}
+	if limiter == nil {
+		return nil, false
+	}
+	return limiter, true
+}
+
+func ServeHTTP(staticDir string, ladders LadderProvider, shapers *ShaperRegistry) {
 	var (
 		err     error
 		addr    *string = flag.String("addr", ":8080", "the address to listen on, default :8080")
@@ -29,8 +51,9 @@ func ServeHTTP(staticDir string) {
 	handler = &http.ServeMux{}
 
 	if limiter, err = NewBandwidthLimiter(); err != nil {
+		// Sessions can still be shaped
 		log.Printf("Error: %s\n", err)
-		return
+		limiter = nil
 	}
 
 	// limiter.SetBandwidth([]Trajectory{{Speed: 5000, Duration: 0, Latency: 50}})
@@ -38,19 +61,74 @@ func ServeHTTP(staticDir string) {
 	// static file host
 	handler.Handle("/", Cors(http.FileServer(http.Dir(staticDir))))
 
+	handler.HandleFunc("/ladder", func(w http.ResponseWriter, r *http.Request) {
+		// Case: GET /ladder?namespace=<track namespace>&track=<track name> -> responds with { "namespace": string, "track": string, "qualities": [{ "bitrate": uint64, "resolution": string, ... }] }
+		var (
+			report LadderReport = LadderReport{Namespace: r.URL.Query().Get("namespace"), Track: r.URL.Query().Get("track")}
+			buf    []byte
+			err    error
+		)
+		log.Printf("%s %s\n", r.Method, r.URL.Path)
+
+		if r.Method != "GET" || report.Namespace == "" || report.Track == "" {
+			w.WriteHeader(400)
+			return
+		}
+		report.Qualities = ladders(report.Namespace, report.Track)
+
+		if buf, err = report.Encode(); err != nil {
+			w.WriteHeader(500)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		if _, err = w.Write(buf); err != nil {
+			log.Printf("Error: %s\n", err)
+			return
+		}
+	})
+
 	handler.HandleFunc("/bandwidth/{method}", func(w http.ResponseWriter, r *http.Request) {
+		// Every method applies to the host (tc) or, with ?session=<session name>, to the writes of that subscriber session
 		var (
 			method string = r.PathValue("method")
+			err    error
 		)
 		log.Printf("%s %s\n", r.Method, r.URL.Path)
 
+		if r.Method == "GET" && method == "sessions" {
+			// Case: GET /bandwidth/sessions -> responds with { "sessions": [string] }
+			var (
+				report ShapedSessionsReport = shapers.GetSessions()
+				buf    []byte
+			)
+
+			if buf, err = report.Encode(); err != nil {
+				log.Printf("Error: %s\n", err)
+				return
+			}
+
+			if _, err = w.Write(buf); err != nil {
+				log.Printf("Error: %s\n", err)
+				return
+			}
+			return
+		}
+
+		controller, found := bandwidthController(r, limiter, shapers)
+		if !found {
+			w.WriteHeader(404)
+			return
+		}
+
 		switch r.Method {
 		case "GET":
 			switch method {
 			case "get":
 				// Case: GET /bandwidth/get -> responds with { "currentBandwidth": int64 }
 				var (
-					report BandwidthReport = limiter.GetCurrentBandwidth()
+					report BandwidthReport = controller.GetCurrentBandwidth()
 					buf    []byte
 				)
 
@@ -85,11 +163,50 @@ func ServeHTTP(staticDir string) {
 					return
 				}
 
-				go limiter.SetBandwidth(trajectory)
+				if err = controller.ValidateTrajectory(trajectory, 0); err != nil {
+					log.Printf("Error: %s\n", err)
+					w.WriteHeader(400)
+					return
+				}
+
+				go controller.SetBandwidth(trajectory)
+				w.WriteHeader(200)
+			case "play":
+				// Case: POST /bandwidth/play with Body: { "segments": [{ "steps": [...] } | { "trace": { "format": string, "data": string, ... } } | { "ramp": {...} } | { "randomWalk": {...} }], "loops": int } parsed to ``TrajectorySpec`` -> responds with 200 immediately (400 if invalid)
+				var (
+					buf        []byte
+					spec       TrajectorySpec
+					trajectory []Trajectory
+				)
+
+				if buf, err = readToEOF(r.Body); err != nil {
+					log.Printf("Error: %s\n", err)
+					return
+				}
+
+				if err = json.Unmarshal(buf, &spec); err != nil {
+					log.Printf("Error: %s\n", err)
+					w.WriteHeader(400)
+					return
+				}
+
+				if trajectory, err = spec.Build(); err != nil {
+					log.Printf("Error: %s\n", err)
+					w.WriteHeader(400)
+					return
+				}
+
+				if err = controller.ValidateTrajectory(trajectory, spec.Loops); err != nil {
+					log.Printf("Error: %s\n", err)
+					w.WriteHeader(400)
+					return
+				}
+
+				go controller.PlayBandwidth(trajectory, spec.Loops)
 				w.WriteHeader(200)
 			case "reset":
 				// Case: POST /bandwidth/reset -> responds with 200 immediately
-				limiter.DeleteBandwidth()
+				controller.DeleteBandwidth()
 			default:
 				w.WriteHeader(500)
 			}
@@ -62,8 +62,8 @@ func (loc *LocPackager) Copy() (newLoc LocPackager) {
 	newLoc.SeqId = loc.SeqId
 	newLoc.FirstFrameClkms = loc.FirstFrameClkms
 	newLoc.PId = loc.PId
-	copy(newLoc.MetaData, loc.MetaData)
-	copy(newLoc.Data, loc.Data)
+	newLoc.MetaData = append([]byte{}, loc.MetaData...)
+	newLoc.Data = append([]byte{}, loc.Data...)
 	return
 }
 
@@ -83,6 +83,19 @@ func (loc *LocPackager) SetData(MediaType string, Timestamp uint64, Duration uin
 }
 
 func (loc *LocPackager) Decode(reader io.Reader) (err error) {
+	if err = loc.DecodeHeader(reader); err != nil {
+		return
+	}
+
+	if loc.Data, err = io.ReadAll(reader); err != nil {
+		return
+	}
+
+	return
+}
+
+// Decodes everything but the data, so the data can be read incrementally
+func (loc *LocPackager) DecodeHeader(reader io.Reader) (err error) {
 	var (
 		mediaTypeInt, chunkTypeInt, metaDataSize uint64
 
@@ -138,14 +151,20 @@ func (loc *LocPackager) Decode(reader io.Reader) (err error) {
 		loc.MetaData = metaData
 	}
 
-	if loc.Data, err = io.ReadAll(reader); err != nil {
+	return
+}
+
+func (loc *LocPackager) Encode() (buf []byte, err error) {
+	if buf, err = loc.EncodeHeader(); err != nil {
 		return
 	}
+	buf = append(buf, loc.Data...)
 
 	return
 }
 
-func (loc *LocPackager) Encode() (buf []byte, err error) {
+// Encodes everything but the data, the data can be appended as it arrives
+func (loc *LocPackager) EncodeHeader() (buf []byte, err error) {
 	var (
 		mediaTypeBytes, chunkTypeBytes, seqIdBytes, timestampBytes, durationBytes, firstFrameClkmsBytes, metaDataSizeBytes []byte
 
@@ -206,7 +225,6 @@ func (loc *LocPackager) Encode() (buf []byte, err error) {
 	buf = append(buf, firstFrameClkmsBytes...)
 	buf = append(buf, metaDataSizeBytes...)
 	buf = append(buf, loc.MetaData...)
-	buf = append(buf, loc.Data...)
 
 	return
 }
@@ -0,0 +1,302 @@
+package awt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Smallest burst (a full size packet as tc tbf), the burst is SHAPER_BURST_MS worth of bytes at the current speed
+const SHAPER_MIN_BURST_BYTES = 1540
+const SHAPER_BURST_MS = 10
+
+// Traffic shaping in userspace (token bucket) of the writes of one session, it does NOT need root and only
+// affects that session. Trajectory steps are played as in BandwidthLimiter, but Latency is an added delay
+// of every stream (ms) instead of the tc queue latency
+type Shaper struct {
+	// kbps, -1 means no limit
+	currentBandwidth int64
+	latency          time.Duration
+	bytesPerS        float64
+	burst            float64
+	tokens           float64
+	lastRefill       time.Time
+	// Incremented on every change, the trajectory being played stops when it does NOT match
+	generation uint64
+	// Closed on every change, so the trajectory being played does NOT wait for its step to finish
+	abort chan struct{}
+
+	lock *sync.Mutex
+}
+
+func NewShaper() *Shaper {
+	return &Shaper{currentBandwidth: -1, lastRefill: time.Now(), lock: new(sync.Mutex)}
+}
+
+// Any step duration is allowed (0 holds the step until changed), but looped trajectories need a duration on every step
+func (s *Shaper) ValidateTrajectory(trajectory []Trajectory, loops int) error {
+	if len(trajectory) <= 0 {
+		return errors.New("Empty trajectory")
+	}
+	if loops != 0 {
+		for i, step := range trajectory {
+			if step.Duration <= 0 {
+				return errors.New(fmt.Sprintf("Step %d has no duration, it can NOT be looped", i))
+			}
+		}
+	}
+	return nil
+}
+
+// Plays the trajectory, it returns when finished or replaced by another one
+func (s *Shaper) SetBandwidth(trajectory []Trajectory) {
+	s.PlayBandwidth(trajectory, 0)
+}
+
+// Plays the trajectory loops more times after the first one (forever if negative)
+func (s *Shaper) PlayBandwidth(trajectory []Trajectory, loops int) {
+	if err := s.ValidateTrajectory(trajectory, loops); err != nil {
+		log.Printf("Error: %s\n", err)
+		return
+	}
+
+	s.lock.Lock()
+	s.changedLocked()
+	generation, abort := s.generation, s.abort
+	s.lock.Unlock()
+
+	for loop := 0; loops < 0 || loop <= loops; loop++ {
+		for _, step := range trajectory {
+			if !s.setStep(generation, step) {
+				return
+			}
+			if step.Duration <= 0 {
+				// Until changed
+				return
+			}
+			timer := time.NewTimer(time.Duration(step.Duration) * time.Millisecond)
+			select {
+			case <-abort:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+// Stops the trajectory being played
+func (s *Shaper) changedLocked() {
+	s.generation++
+	if s.abort != nil {
+		close(s.abort)
+	}
+	s.abort = make(chan struct{})
+}
+
+func (s *Shaper) setStep(generation uint64, step Trajectory) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if generation != s.generation {
+		return false
+	}
+	s.refillLocked(time.Now())
+	s.currentBandwidth = step.Speed
+	s.latency = time.Duration(step.Latency) * time.Millisecond
+	s.bytesPerS = 0
+	if step.Speed > 0 {
+		s.bytesPerS = float64(step.Speed) * 1000 / 8
+	}
+	s.burst = max(SHAPER_MIN_BURST_BYTES, s.bytesPerS*SHAPER_BURST_MS/1000)
+	s.tokens = min(s.tokens, s.burst)
+	return true
+}
+
+// Removes the limit (and stops the trajectory)
+func (s *Shaper) DeleteBandwidth() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.changedLocked()
+	s.currentBandwidth = -1
+	s.latency = 0
+	s.bytesPerS = 0
+	s.tokens = 0
+}
+
+func (s *Shaper) GetCurrentBandwidth() BandwidthReport {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return BandwidthReport{
+		CurrentBandwidth: s.currentBandwidth,
+	}
+}
+
+func (s *Shaper) refillLocked(now time.Time) {
+	s.tokens = min(s.burst, s.tokens+now.Sub(s.lastRefill).Seconds()*s.bytesPerS)
+	s.lastRefill = now
+}
+
+// Takes n bytes from the bucket (it can go into debt, so concurrent writers queue in order) and returns how
+// long to wait before sending them
+func (s *Shaper) reserve(n int) time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.bytesPerS <= 0 {
+		return 0
+	}
+	s.refillLocked(time.Now())
+	s.tokens -= float64(n)
+	if s.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-s.tokens / s.bytesPerS * float64(time.Second))
+}
+
+// Largest write that fits in the bucket
+func (s *Shaper) chunkSize() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.bytesPerS <= 0 {
+		return 0
+	}
+	return int(s.burst)
+}
+
+func (s *Shaper) getLatency() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.latency
+}
+
+// Writer of one stream, the first write is delayed by the latency and the rest are paced by the bucket.
+// Limit changes apply to the writes done after them
+func (s *Shaper) Writer(ctx context.Context, w io.Writer) io.Writer {
+	return &shapedWriter{ctx: ctx, w: w, shaper: s}
+}
+
+type shapedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	shaper  *Shaper
+	delayed bool
+}
+
+func (w *shapedWriter) Write(p []byte) (total int, err error) {
+	if !w.delayed {
+		w.delayed = true
+		if err = w.sleep(w.shaper.getLatency()); err != nil {
+			return
+		}
+	}
+	for len(p) > 0 {
+		size := len(p)
+		if chunkSize := w.shaper.chunkSize(); chunkSize > 0 {
+			size = min(size, chunkSize)
+		}
+		if err = w.sleep(w.shaper.reserve(size)); err != nil {
+			return
+		}
+		var n int
+		n, err = w.w.Write(p[:size])
+		total += n
+		if err != nil {
+			return
+		}
+		p = p[size:]
+	}
+	return
+}
+
+func (w *shapedWriter) sleep(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Sessions that can be shaped
+type ShapedSessionsReport struct {
+	Sessions []string `json:"sessions"`
+}
+
+func (r *ShapedSessionsReport) Encode() (buf []byte, err error) {
+	if buf, err = json.Marshal(r); err != nil {
+		log.Printf("Error: %s\n", err)
+		return
+	}
+	return
+}
+
+// Shaper of every subscriber session by session name
+type ShaperRegistry struct {
+	shapers map[string]*Shaper
+
+	lock *sync.RWMutex
+}
+
+func NewShaperRegistry() *ShaperRegistry {
+	return &ShaperRegistry{shapers: map[string]*Shaper{}, lock: new(sync.RWMutex)}
+}
+
+// New shaper (no limit) of the session
+func (r *ShaperRegistry) Add(session string) *Shaper {
+	shaper := NewShaper()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.shapers[session] = shaper
+	return shaper
+}
+
+// Also stops its trajectory
+func (r *ShaperRegistry) Remove(session string) {
+	r.lock.Lock()
+	shaper, found := r.shapers[session]
+	delete(r.shapers, session)
+	r.lock.Unlock()
+
+	if found {
+		shaper.DeleteBandwidth()
+	}
+}
+
+func (r *ShaperRegistry) Get(session string) (shaper *Shaper, found bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	shaper, found = r.shapers[session]
+	return
+}
+
+func (r *ShaperRegistry) GetSessions() ShapedSessionsReport {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	report := ShapedSessionsReport{Sessions: []string{}}
+	for session := range r.shapers {
+		report.Sessions = append(report.Sessions, session)
+	}
+	slices.Sort(report.Sessions)
+	return report
+}
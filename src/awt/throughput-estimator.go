@@ -0,0 +1,169 @@
+package awt
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Estimator names
+const (
+	ESTIMATOR_STREAM = "stream"
+	ESTIMATOR_EWMA   = "ewma"
+	ESTIMATOR_WINDOW = "window"
+	ESTIMATOR_CWND   = "cwnd"
+)
+
+const DEFAULT_ESTIMATOR = ESTIMATOR_STREAM
+
+// Every estimator, the order of the estimates log
+var Estimators = []string{ESTIMATOR_STREAM, ESTIMATOR_EWMA, ESTIMATOR_WINDOW, ESTIMATOR_CWND}
+
+// Streams smaller than this (ex: audio objects) are sent in a few packets, their throughput says more about
+// the sender than about the network, averaging estimators skip them once they have an estimate
+const ESTIMATOR_MIN_SAMPLE_BYTES = 8 * 1024
+
+// Weight of the newest sample
+const EWMA_ALPHA = 0.3
+
+// Samples averaged
+const WINDOW_SIZE = 8
+
+// Estimates the throughput of a connection from its finished streams and / or its congestion controller
+type ThroughputEstimator interface {
+	Name() string
+	// A stream was finished (FIN sent), bytes sent between its first and last packet
+	StreamFinished(bytes uint64, elapsed time.Duration)
+	// Congestion controller metrics were updated (on every ACK)
+	UpdatedMetrics(rtt time.Duration, cwnd uint64, bytesInFlight uint64)
+	// In kbps, 0 means no estimate yet
+	Estimate() uint64
+}
+
+func NewEstimator(name string) (ThroughputEstimator, error) {
+	switch name {
+	case ESTIMATOR_STREAM:
+		return &streamEstimator{}, nil
+	case ESTIMATOR_EWMA:
+		return &ewmaEstimator{}, nil
+	case ESTIMATOR_WINDOW:
+		return &windowEstimator{}, nil
+	case ESTIMATOR_CWND:
+		return &cwndEstimator{}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Invalid throughput estimator %s", name))
+}
+
+// kbps of a stream, 0 if it was sent in a single packet
+func streamKbps(bytes uint64, elapsed time.Duration) uint64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return uint64(float64(bytes*8) / (float64(elapsed) / float64(time.Millisecond)))
+}
+
+// Throughput of the last finished stream
+type streamEstimator struct {
+	estimate uint64
+}
+
+func (e *streamEstimator) Name() string {
+	return ESTIMATOR_STREAM
+}
+
+func (e *streamEstimator) StreamFinished(bytes uint64, elapsed time.Duration) {
+	if kbps := streamKbps(bytes, elapsed); kbps > 0 {
+		e.estimate = kbps
+	}
+}
+
+func (e *streamEstimator) UpdatedMetrics(_ time.Duration, _ uint64, _ uint64) {
+}
+
+func (e *streamEstimator) Estimate() uint64 {
+	return e.estimate
+}
+
+// Exponentially weighted moving average of the stream throughputs
+type ewmaEstimator struct {
+	estimate float64
+}
+
+func (e *ewmaEstimator) Name() string {
+	return ESTIMATOR_EWMA
+}
+
+func (e *ewmaEstimator) StreamFinished(bytes uint64, elapsed time.Duration) {
+	kbps := streamKbps(bytes, elapsed)
+	if kbps <= 0 || (bytes < ESTIMATOR_MIN_SAMPLE_BYTES && e.estimate > 0) {
+		return
+	}
+	if e.estimate <= 0 {
+		e.estimate = float64(kbps)
+		return
+	}
+	e.estimate = EWMA_ALPHA*float64(kbps) + (1-EWMA_ALPHA)*e.estimate
+}
+
+func (e *ewmaEstimator) UpdatedMetrics(_ time.Duration, _ uint64, _ uint64) {
+}
+
+func (e *ewmaEstimator) Estimate() uint64 {
+	return uint64(e.estimate)
+}
+
+// Harmonic mean of the latest stream throughputs (low samples weigh more, like in player side ABR)
+type windowEstimator struct {
+	samples []uint64
+}
+
+func (e *windowEstimator) Name() string {
+	return ESTIMATOR_WINDOW
+}
+
+func (e *windowEstimator) StreamFinished(bytes uint64, elapsed time.Duration) {
+	kbps := streamKbps(bytes, elapsed)
+	if kbps <= 0 || (bytes < ESTIMATOR_MIN_SAMPLE_BYTES && len(e.samples) > 0) {
+		return
+	}
+	e.samples = append(e.samples[max(0, len(e.samples)+1-WINDOW_SIZE):], kbps)
+}
+
+func (e *windowEstimator) UpdatedMetrics(_ time.Duration, _ uint64, _ uint64) {
+}
+
+func (e *windowEstimator) Estimate() uint64 {
+	if len(e.samples) <= 0 {
+		return 0
+	}
+	sum := float64(0)
+	for _, sample := range e.samples {
+		sum += 1 / float64(sample)
+	}
+	return uint64(float64(len(e.samples)) / sum)
+}
+
+// Rate the congestion controller allows (congestion window per RTT), it does NOT depend on the object sizes.
+// If the connection is application limited (few bytes in flight) the window does NOT grow, so it is a lower bound
+type cwndEstimator struct {
+	rtt           time.Duration
+	cwnd          uint64
+	bytesInFlight uint64
+}
+
+func (e *cwndEstimator) Name() string {
+	return ESTIMATOR_CWND
+}
+
+func (e *cwndEstimator) StreamFinished(_ uint64, _ time.Duration) {
+}
+
+func (e *cwndEstimator) UpdatedMetrics(rtt time.Duration, cwnd uint64, bytesInFlight uint64) {
+	e.rtt = rtt
+	e.cwnd = cwnd
+	e.bytesInFlight = bytesInFlight
+}
+
+func (e *cwndEstimator) Estimate() uint64 {
+	return streamKbps(max(e.cwnd, e.bytesInFlight), e.rtt)
+}
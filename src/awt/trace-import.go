@@ -0,0 +1,217 @@
+package awt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Trace formats
+const (
+	// Mahimahi packet delivery trace, one line per 1500 byte delivery opportunity (ms timestamp)
+	TRACE_FORMAT_MAHIMAHI = "mahimahi"
+	// Throughput samples "time_s,throughput_mbps" (comma or whitespace separated), the cooked format of the
+	// FCC broadband, 3G (HSDPA) and 4G datasets used in ABR research
+	TRACE_FORMAT_CSV = "csv"
+	// Raw 3G (HSDPA) logs "unix_time ms_since_start lat lon bytes elapsed_ms"
+	TRACE_FORMAT_HSDPA = "hsdpa"
+)
+
+const MAHIMAHI_PACKET_BYTES = 1500
+
+// Throughput samples per step of Mahimahi traces (in milliseconds)
+const TRACE_BIN_MS = 1000
+
+// Outages are played at this speed (kbps), 0 means no limit
+const TRACE_MIN_SPEED = 1
+
+// Longest trace and most steps imported, longer traces are rejected
+const TRACE_MAX_DURATION_MS = 24 * 60 * 60 * 1000
+const TRACE_MAX_STEPS = 100000
+
+// Imports a trace as steps, latency (ms) is set on all of them
+func ImportTrace(format string, reader io.Reader, binMs uint64, latency uint64) (trajectory []Trajectory, err error) {
+	switch format {
+	case TRACE_FORMAT_MAHIMAHI:
+		if binMs <= 0 {
+			binMs = TRACE_BIN_MS
+		}
+		trajectory, err = importMahimahi(reader, binMs)
+	case TRACE_FORMAT_CSV:
+		trajectory, err = importThroughputCSV(reader)
+	case TRACE_FORMAT_HSDPA:
+		trajectory, err = importHSDPA(reader)
+	default:
+		err = errors.New(fmt.Sprintf("Invalid trace format %s", format))
+	}
+	if err != nil {
+		return
+	}
+	if len(trajectory) <= 0 {
+		err = errors.New(fmt.Sprintf("Empty %s trace", format))
+		return
+	}
+	if len(trajectory) > TRACE_MAX_STEPS {
+		err = errors.New(fmt.Sprintf("Too many steps in %s trace: %d, max: %d", format, len(trajectory), TRACE_MAX_STEPS))
+		return
+	}
+	for i := range trajectory {
+		trajectory[i].Speed = max(TRACE_MIN_SPEED, trajectory[i].Speed)
+		trajectory[i].Latency = latency
+	}
+	return
+}
+
+// Fields of every line with data (blank lines and # comments skipped)
+func traceLines(reader io.Reader, onLine func(lineNum int, fields []string) error) error {
+	scanner := bufio.NewScanner(reader)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ';' || r == ' ' || r == '\t'
+		})
+		if err := onLine(lineNum, fields); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func importMahimahi(reader io.Reader, binMs uint64) (trajectory []Trajectory, err error) {
+	var (
+		bins   []uint64
+		lastMs uint64
+	)
+	if binMs <= 0 {
+		err = errors.New("Mahimahi trace needs a bin duration")
+		return
+	}
+	err = traceLines(reader, func(lineNum int, fields []string) error {
+		ms, errParse := strconv.ParseUint(fields[0], 10, 64)
+		if errParse != nil {
+			return errors.New(fmt.Sprintf("Mahimahi trace line %d: %v", lineNum, errParse))
+		}
+		if ms < lastMs {
+			return errors.New(fmt.Sprintf("Mahimahi trace line %d: timestamps going backwards", lineNum))
+		}
+		bin := ms / binMs
+		if ms > TRACE_MAX_DURATION_MS || bin >= TRACE_MAX_STEPS {
+			return errors.New(fmt.Sprintf("Mahimahi trace line %d: trace too long, max: %dms and %d bins", lineNum, TRACE_MAX_DURATION_MS, TRACE_MAX_STEPS))
+		}
+		lastMs = ms
+		for uint64(len(bins)) <= bin {
+			bins = append(bins, 0)
+		}
+		bins[bin]++
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if lastMs <= 0 {
+		err = errors.New("Mahimahi trace lasts 0ms")
+		return
+	}
+
+	// The trace repeats after the last timestamp, so deliveries at exactly lastMs end the last bin (they
+	// would start a bin of 0ms when lastMs is a multiple of binMs)
+	if numBins := (lastMs + binMs - 1) / binMs; uint64(len(bins)) > numBins {
+		bins[numBins-1] += bins[numBins]
+		bins = bins[:numBins]
+	}
+	for i, packets := range bins {
+		// The last bin can be shorter
+		durationMs := min(binMs, lastMs-uint64(i)*binMs)
+		trajectory = append(trajectory, Trajectory{Speed: int64(packets * MAHIMAHI_PACKET_BYTES * 8 / durationMs), Duration: durationMs})
+	}
+	return
+}
+
+func importThroughputCSV(reader io.Reader) (trajectory []Trajectory, err error) {
+	var (
+		times []float64
+		mbps  []float64
+	)
+	err = traceLines(reader, func(lineNum int, fields []string) error {
+		if len(fields) < 2 {
+			return errors.New(fmt.Sprintf("CSV trace line %d: expected time and throughput", lineNum))
+		}
+		timeS, errTime := strconv.ParseFloat(fields[0], 64)
+		throughput, errThroughput := strconv.ParseFloat(fields[1], 64)
+		if errTime != nil || errThroughput != nil {
+			if len(times) <= 0 {
+				// Header
+				return nil
+			}
+			return errors.New(fmt.Sprintf("CSV trace line %d: invalid number", lineNum))
+		}
+		if len(times) > 0 && timeS <= times[len(times)-1] {
+			return errors.New(fmt.Sprintf("CSV trace line %d: timestamps NOT increasing", lineNum))
+		}
+		if len(times) > 0 && (timeS-times[0])*1000 > TRACE_MAX_DURATION_MS {
+			return errors.New(fmt.Sprintf("CSV trace line %d: trace too long, max: %dms", lineNum, TRACE_MAX_DURATION_MS))
+		}
+		times = append(times, timeS)
+		mbps = append(mbps, throughput)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	var (
+		// Samples shorter than 1ms are merged into the next one (average throughput of both)
+		mergedS  float64
+		mergedMb float64
+	)
+	for i := range times {
+		// Every sample lasts until the next one, the last one as long as the previous one (1s if alone)
+		durationS := float64(1)
+		if i+1 < len(times) {
+			durationS = times[i+1] - times[i]
+		} else if i > 0 {
+			durationS = times[i] - times[i-1]
+		}
+		mergedS += durationS
+		mergedMb += mbps[i] * durationS
+		durationMs := uint64(mergedS * 1000)
+		if durationMs <= 0 {
+			if i+1 < len(times) {
+				continue
+			}
+			// Nothing left to merge into
+			durationMs = 1
+		}
+		trajectory = append(trajectory, Trajectory{Speed: int64(mergedMb / mergedS * 1000), Duration: durationMs})
+		mergedS = 0
+		mergedMb = 0
+	}
+	return
+}
+
+func importHSDPA(reader io.Reader) (trajectory []Trajectory, err error) {
+	err = traceLines(reader, func(lineNum int, fields []string) error {
+		if len(fields) < 6 {
+			return errors.New(fmt.Sprintf("HSDPA trace line %d: expected 6 fields, found %d", lineNum, len(fields)))
+		}
+		bytes, errBytes := strconv.ParseUint(fields[4], 10, 64)
+		elapsedMs, errElapsed := strconv.ParseUint(fields[5], 10, 64)
+		if errBytes != nil || errElapsed != nil {
+			return errors.New(fmt.Sprintf("HSDPA trace line %d: invalid number", lineNum))
+		}
+		if elapsedMs <= 0 {
+			return nil
+		}
+		trajectory = append(trajectory, Trajectory{Speed: int64(bytes * 8 / elapsedMs), Duration: elapsedMs})
+		return nil
+	})
+	return
+}
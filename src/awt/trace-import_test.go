@@ -0,0 +1,111 @@
+package awt
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestImportTrace(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		data    string
+		binMs   uint64
+		latency uint64
+		want    []Trajectory
+		wantErr bool
+	}{
+		{
+			name:   "mahimahi bins",
+			format: TRACE_FORMAT_MAHIMAHI,
+			data:   "1\n500\n1000\n1500\n1999\n",
+			binMs:  1000,
+			// 2 packets in the first 1000ms, 3 in the last 999ms
+			want: []Trajectory{{Speed: 24, Duration: 1000}, {Speed: 36, Duration: 999}},
+		},
+		{
+			name:   "mahimahi delivery at the end of the last bin",
+			format: TRACE_FORMAT_MAHIMAHI,
+			data:   "1\n500\n1000\n1500\n2000\n",
+			binMs:  1000,
+			want:   []Trajectory{{Speed: 24, Duration: 1000}, {Speed: 36, Duration: 1000}},
+		},
+		{
+			name:   "mahimahi default bin and latency",
+			format: TRACE_FORMAT_MAHIMAHI,
+			data:   "# comment\n\n1000\n",
+			binMs:  0,
+			// The only delivery ends the only bin
+			latency: 20,
+			want:    []Trajectory{{Speed: 12, Duration: 1000, Latency: 20}},
+		},
+		{
+			name:   "mahimahi outage at min speed",
+			format: TRACE_FORMAT_MAHIMAHI,
+			data:   "10\n2500\n",
+			binMs:  1000,
+			want:   []Trajectory{{Speed: 12, Duration: 1000}, {Speed: TRACE_MIN_SPEED, Duration: 1000}, {Speed: 24, Duration: 500}},
+		},
+		{name: "mahimahi 0ms", format: TRACE_FORMAT_MAHIMAHI, data: "0\n0\n", wantErr: true},
+		{name: "mahimahi backwards", format: TRACE_FORMAT_MAHIMAHI, data: "10\n5\n", wantErr: true},
+		{name: "mahimahi too long", format: TRACE_FORMAT_MAHIMAHI, data: "1\n999999999\n", binMs: 1, wantErr: true},
+		{name: "mahimahi too many bins", format: TRACE_FORMAT_MAHIMAHI, data: "1\n100000\n", binMs: 1, wantErr: true},
+		{
+			name:   "csv with header",
+			format: TRACE_FORMAT_CSV,
+			data:   "time_s,mbps\n0,1\n1,2.5\n3,0\n",
+			// The last sample lasts as the previous one
+			want: []Trajectory{{Speed: 1000, Duration: 1000}, {Speed: 2500, Duration: 2000}, {Speed: TRACE_MIN_SPEED, Duration: 2000}},
+		},
+		{
+			name:   "csv single sample",
+			format: TRACE_FORMAT_CSV,
+			data:   "5 4\n",
+			want:   []Trajectory{{Speed: 4000, Duration: 1000}},
+		},
+		{
+			name:   "csv sub ms samples merged",
+			format: TRACE_FORMAT_CSV,
+			data:   "0,1\n0.0005,3\n1,2\n",
+			// 1 Mbps for 0.5ms and 3 Mbps for 999.5ms
+			want: []Trajectory{{Speed: 2999, Duration: 1000}, {Speed: 2000, Duration: 999}},
+		},
+		{
+			name:   "csv sub ms last samples",
+			format: TRACE_FORMAT_CSV,
+			data:   "0,1\n0.0004,3\n",
+			want:   []Trajectory{{Speed: 2000, Duration: 1}},
+		},
+		{name: "csv NOT increasing", format: TRACE_FORMAT_CSV, data: "1,1\n1,2\n", wantErr: true},
+		{name: "csv invalid number", format: TRACE_FORMAT_CSV, data: "0,1\n1,x\n", wantErr: true},
+		{name: "csv too long", format: TRACE_FORMAT_CSV, data: "0,1\n100000,1\n", wantErr: true},
+		{
+			name:   "hsdpa",
+			format: TRACE_FORMAT_HSDPA,
+			data:   "1289406399 0 59.85 10.65 125000 1000\n1289406400 1000 59.85 10.65 0 0\n1289406401 2000 59.85 10.65 50000 500\n",
+			want:   []Trajectory{{Speed: 1000, Duration: 1000}, {Speed: 800, Duration: 500}},
+		},
+		{name: "hsdpa missing fields", format: TRACE_FORMAT_HSDPA, data: "1289406399 0 59.85\n", wantErr: true},
+		{name: "empty", format: TRACE_FORMAT_CSV, data: "# nothing\n", wantErr: true},
+		{name: "invalid format", format: "pcap", data: "1\n", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ImportTrace(test.format, strings.NewReader(test.data), test.binMs, test.latency)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
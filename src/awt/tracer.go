@@ -0,0 +1,212 @@
+package awt
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/quic-go/webtransport-go"
+)
+
+// Streams without sent bytes for this long are forgotten (FIN never sent, or only retransmissions)
+const STREAM_STATS_MAX_IDLE = 10 * time.Second
+
+// ETP samples kept
+const ETP_HISTORY_SIZE = 32
+
+type streamStats struct {
+	first time.Time
+	last  time.Time
+	bytes uint64
+}
+
+// Sent STREAM frames of a connection kept in memory, the ETP is updated when a stream is finished (FIN sent)
+type ConnectionStats struct {
+	id      uint64
+	streams map[logging.StreamID]*streamStats
+	// The first one gives the ETP, the rest are only logged (comparison)
+	estimators   []ThroughputEstimator
+	estimatesLog *EstimatesLog
+	// In kbps, estimate after every finished stream, oldest first
+	etpHistory    []uint64
+	rtt           time.Duration
+	cwnd          uint64
+	bytesInFlight uint64
+	lastPrune     time.Time
+
+	lock *sync.Mutex
+}
+
+// estimatesLog can be nil
+func NewConnectionStats(id uint64, estimators []ThroughputEstimator, estimatesLog *EstimatesLog) *ConnectionStats {
+	return &ConnectionStats{id: id, streams: map[logging.StreamID]*streamStats{}, estimators: estimators, estimatesLog: estimatesLog, lastPrune: time.Now(), lock: new(sync.Mutex)}
+}
+
+// Tracer that feeds the stats, onClose is called when the connection closes
+func (c *ConnectionStats) Tracer(onClose func()) *logging.ConnectionTracer {
+	return &logging.ConnectionTracer{
+		SentLongHeaderPacket: func(_ *logging.ExtendedHeader, _ logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, frames []logging.Frame) {
+			c.sentFrames(time.Now(), frames)
+		},
+		SentShortHeaderPacket: func(_ *logging.ShortHeader, _ logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, frames []logging.Frame) {
+			c.sentFrames(time.Now(), frames)
+		},
+		UpdatedMetrics: func(rttStats *logging.RTTStats, cwnd logging.ByteCount, bytesInFlight logging.ByteCount, _ int) {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+
+			c.rtt = rttStats.SmoothedRTT()
+			c.cwnd = uint64(cwnd)
+			c.bytesInFlight = uint64(bytesInFlight)
+			for _, estimator := range c.estimators {
+				estimator.UpdatedMetrics(c.rtt, c.cwnd, c.bytesInFlight)
+			}
+		},
+		Close: onClose,
+	}
+}
+
+func (c *ConnectionStats) sentFrames(now time.Time, frames []logging.Frame) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, frame := range frames {
+		streamFrame, ok := frame.(*logging.StreamFrame)
+		if !ok {
+			continue
+		}
+		stats, found := c.streams[streamFrame.StreamID]
+		if !found {
+			stats = &streamStats{first: now}
+			c.streams[streamFrame.StreamID] = stats
+		}
+		stats.last = now
+		stats.bytes += uint64(streamFrame.Length)
+
+		if streamFrame.Fin {
+			c.streamFinishedLocked(now, stats)
+			delete(c.streams, streamFrame.StreamID)
+		}
+	}
+
+	if now.Sub(c.lastPrune) >= STREAM_STATS_MAX_IDLE {
+		for streamID, stats := range c.streams {
+			if now.Sub(stats.last) >= STREAM_STATS_MAX_IDLE {
+				delete(c.streams, streamID)
+			}
+		}
+		c.lastPrune = now
+	}
+}
+
+func (c *ConnectionStats) streamFinishedLocked(now time.Time, stats *streamStats) {
+	for _, estimator := range c.estimators {
+		estimator.StreamFinished(stats.bytes, stats.last.Sub(stats.first))
+	}
+	if etp := c.estimators[0].Estimate(); etp > 0 {
+		c.etpHistory = append(c.etpHistory[max(0, len(c.etpHistory)+1-ETP_HISTORY_SIZE):], etp)
+	}
+	if c.estimatesLog != nil {
+		c.estimatesLog.Write(now, c.id, c.estimators, c.rtt, c.cwnd, c.bytesInFlight)
+	}
+}
+
+// Estimated throughput in kbps (0 until there is an estimate)
+func (c *ConnectionStats) ETP() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.etpHistory) <= 0 {
+		return 0
+	}
+	return c.etpHistory[len(c.etpHistory)-1]
+}
+
+// Latest ETP samples (kbps), oldest first
+func (c *ConnectionStats) ETPHistory() []uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return slices.Clone(c.etpHistory)
+}
+
+// Smoothed RTT (0 until measured)
+func (c *ConnectionStats) RTT() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.rtt
+}
+
+// Stats of every open connection by tracing id, so WebTransport sessions can find the ones of their connection
+type ConnectionStatsRegistry struct {
+	conns map[quic.ConnectionTracingID]*ConnectionStats
+	// Throughput estimator of the ETP
+	estimator    string
+	estimatesLog *EstimatesLog
+
+	lock *sync.RWMutex
+}
+
+// Every connection gets its ETP from estimator, with estimatesLog (can be nil) all estimators are run and logged
+func NewConnectionStatsRegistry(estimator string, estimatesLog *EstimatesLog) (*ConnectionStatsRegistry, error) {
+	if _, err := NewEstimator(estimator); err != nil {
+		return nil, err
+	}
+	return &ConnectionStatsRegistry{conns: map[quic.ConnectionTracingID]*ConnectionStats{}, estimator: estimator, estimatesLog: estimatesLog, lock: new(sync.RWMutex)}, nil
+}
+
+func (r *ConnectionStatsRegistry) newEstimators() []ThroughputEstimator {
+	// Validated on creation
+	estimator, _ := NewEstimator(r.estimator)
+	estimators := []ThroughputEstimator{estimator}
+	if r.estimatesLog == nil {
+		return estimators
+	}
+	for _, name := range Estimators {
+		if name != r.estimator {
+			estimator, _ = NewEstimator(name)
+			estimators = append(estimators, estimator)
+		}
+	}
+	return estimators
+}
+
+// Creates the stats of a new connection (ctx from quic.Config.Tracer), they are removed when it closes
+func (r *ConnectionStatsRegistry) NewTracer(ctx context.Context) (tracer *logging.ConnectionTracer, err error) {
+	id, ok := ctx.Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+	if !ok {
+		return nil, ErrInvalidConnectionTracingKey
+	}
+	stats := NewConnectionStats(uint64(id), r.newEstimators(), r.estimatesLog)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.conns[id] = stats
+
+	return stats.Tracer(func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		delete(r.conns, id)
+	}), nil
+}
+
+func (r *ConnectionStatsRegistry) Get(session *webtransport.Session) (stats *ConnectionStats, err error) {
+	id, ok := session.Context().Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+	if !ok {
+		return nil, ErrInvalidConnectionTracingKey
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if stats, ok = r.conns[id]; !ok {
+		return nil, ErrInvalidConnectionTracingKey
+	}
+	return
+}
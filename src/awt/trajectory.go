@@ -0,0 +1,182 @@
+package awt
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Step of generated segments when NOT set (in milliseconds)
+const GENERATOR_STEP_MS = 1000
+
+// Linear change of speed (kbps) over the duration (ms)
+type Ramp struct {
+	From     int64  `json:"from"`
+	To       int64  `json:"to"`
+	Duration uint64 `json:"duration"`
+	StepMs   uint64 `json:"stepMs,omitempty"`
+	Latency  uint64 `json:"latency,omitempty"`
+}
+
+// Speed (kbps) changing by a random amount up to MaxChange every step, kept in [Min, Max]. The same seed
+// gives the same trajectory (0 means random)
+type RandomWalk struct {
+	Start     int64  `json:"start"`
+	Min       int64  `json:"min"`
+	Max       int64  `json:"max"`
+	MaxChange int64  `json:"maxChange"`
+	Duration  uint64 `json:"duration"`
+	StepMs    uint64 `json:"stepMs,omitempty"`
+	Latency   uint64 `json:"latency,omitempty"`
+	Seed      int64  `json:"seed,omitempty"`
+}
+
+// Trace in one of the TRACE_FORMAT_* formats, sent inline
+type Trace struct {
+	Format  string `json:"format"`
+	Data    string `json:"data"`
+	BinMs   uint64 `json:"binMs,omitempty"`
+	Latency uint64 `json:"latency,omitempty"`
+}
+
+// Part of a trajectory, only one of the fields is set
+type TrajectorySegment struct {
+	Steps      []Trajectory `json:"steps,omitempty"`
+	Trace      *Trace       `json:"trace,omitempty"`
+	Ramp       *Ramp        `json:"ramp,omitempty"`
+	RandomWalk *RandomWalk  `json:"randomWalk,omitempty"`
+}
+
+// Segments played one after the other, Loops more times after the first one (forever if negative)
+type TrajectorySpec struct {
+	Segments []TrajectorySegment `json:"segments"`
+	Loops    int                 `json:"loops,omitempty"`
+}
+
+// Steps of the whole spec
+func (s *TrajectorySpec) Build() (trajectory []Trajectory, err error) {
+	for i, segment := range s.Segments {
+		var steps []Trajectory
+		if steps, err = segment.build(); err != nil {
+			err = errors.New(fmt.Sprintf("Segment %d: %v", i, err))
+			return
+		}
+		trajectory = append(trajectory, steps...)
+	}
+	if len(trajectory) <= 0 {
+		err = errors.New("Empty trajectory")
+		return
+	}
+	if s.Loops != 0 {
+		for _, step := range trajectory {
+			if step.Duration <= 0 {
+				err = errors.New("Looped trajectories need a duration on every step")
+				return
+			}
+		}
+	}
+	return
+}
+
+func (s *TrajectorySegment) build() ([]Trajectory, error) {
+	switch {
+	case s.Steps != nil:
+		return s.Steps, nil
+	case s.Trace != nil:
+		return ImportTrace(s.Trace.Format, strings.NewReader(s.Trace.Data), s.Trace.BinMs, s.Trace.Latency)
+	case s.Ramp != nil:
+		return s.Ramp.Generate()
+	case s.RandomWalk != nil:
+		return s.RandomWalk.Generate()
+	}
+	return nil, errors.New("Empty segment")
+}
+
+func generatorSteps(durationMs uint64, stepMs uint64) (numSteps uint64, err error) {
+	if durationMs <= 0 {
+		err = errors.New("Generators need a duration")
+		return
+	}
+	if durationMs > TRACE_MAX_DURATION_MS {
+		err = errors.New(fmt.Sprintf("Generator too long: %dms, max: %dms", durationMs, TRACE_MAX_DURATION_MS))
+		return
+	}
+	numSteps = max(1, durationMs/stepMs)
+	if numSteps > TRACE_MAX_STEPS {
+		err = errors.New(fmt.Sprintf("Too many generator steps: %d, max: %d", numSteps, TRACE_MAX_STEPS))
+		return
+	}
+	return
+}
+
+func (r *Ramp) Generate() (trajectory []Trajectory, err error) {
+	var (
+		numSteps uint64
+		stepMs   uint64 = r.StepMs
+	)
+	if stepMs <= 0 {
+		stepMs = GENERATOR_STEP_MS
+	}
+	if r.From <= 0 || r.To <= 0 {
+		err = errors.New("Ramp speeds need to be positive")
+		return
+	}
+	if numSteps, err = generatorSteps(r.Duration, stepMs); err != nil {
+		return
+	}
+
+	for i := uint64(0); i < numSteps; i++ {
+		speed := r.From
+		if numSteps > 1 {
+			speed = r.From + (r.To-r.From)*int64(i)/int64(numSteps-1)
+		}
+		duration := stepMs
+		if i == numSteps-1 {
+			// Remainder
+			duration = r.Duration - stepMs*(numSteps-1)
+		}
+		trajectory = append(trajectory, Trajectory{Speed: speed, Duration: duration, Latency: r.Latency})
+	}
+	return
+}
+
+func (w *RandomWalk) Generate() (trajectory []Trajectory, err error) {
+	var (
+		numSteps uint64
+		stepMs   uint64 = w.StepMs
+		seed     int64  = w.Seed
+	)
+	if stepMs <= 0 {
+		stepMs = GENERATOR_STEP_MS
+	}
+	if w.Min <= 0 || w.Max < w.Min || w.Start < w.Min || w.Start > w.Max || w.MaxChange < 0 || w.MaxChange > w.Max-w.Min {
+		err = errors.New(fmt.Sprintf("Random walk needs 0 < min <= start <= max and 0 <= maxChange <= max - min, got min: %d, start: %d, max: %d, maxChange: %d", w.Min, w.Start, w.Max, w.MaxChange))
+		return
+	}
+	if numSteps, err = generatorSteps(w.Duration, stepMs); err != nil {
+		return
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	random := rand.New(rand.NewSource(seed))
+
+	speed := w.Start
+	for i := uint64(0); i < numSteps; i++ {
+		duration := stepMs
+		if i == numSteps-1 {
+			duration = w.Duration - stepMs*(numSteps-1)
+		}
+		trajectory = append(trajectory, Trajectory{Speed: speed, Duration: duration, Latency: w.Latency})
+		// Kept in [Min, Max] without overflowing (maxChange <= max - min)
+		change := random.Int63n(w.MaxChange + 1)
+		if random.Intn(2) == 0 {
+			speed += min(change, w.Max-speed)
+		} else {
+			speed -= min(change, speed-w.Min)
+		}
+	}
+	return
+}
@@ -0,0 +1,111 @@
+package awt
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRampGenerate(t *testing.T) {
+	tests := []struct {
+		name    string
+		ramp    Ramp
+		want    []Trajectory
+		wantErr bool
+	}{
+		{
+			name: "up",
+			ramp: Ramp{From: 1000, To: 3000, Duration: 3000},
+			want: []Trajectory{{Speed: 1000, Duration: 1000}, {Speed: 2000, Duration: 1000}, {Speed: 3000, Duration: 1000}},
+		},
+		{
+			name: "down with remainder",
+			ramp: Ramp{From: 3000, To: 1000, Duration: 2500, StepMs: 1000, Latency: 10},
+			// The last step gets the remainder
+			want: []Trajectory{{Speed: 3000, Duration: 1000, Latency: 10}, {Speed: 1000, Duration: 1500, Latency: 10}},
+		},
+		{
+			name: "shorter than a step",
+			ramp: Ramp{From: 500, To: 2000, Duration: 300},
+			want: []Trajectory{{Speed: 500, Duration: 300}},
+		},
+		{name: "no duration", ramp: Ramp{From: 1, To: 2}, wantErr: true},
+		{name: "speed NOT positive", ramp: Ramp{From: 0, To: 2, Duration: 1000}, wantErr: true},
+		{name: "too long", ramp: Ramp{From: 1, To: 2, Duration: 1e15, StepMs: 1}, wantErr: true},
+		{name: "too many steps", ramp: Ramp{From: 1, To: 2, Duration: TRACE_MAX_STEPS + 1, StepMs: 1}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.ramp.Generate()
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRandomWalkGenerate(t *testing.T) {
+	tests := []struct {
+		name    string
+		walk    RandomWalk
+		wantErr bool
+	}{
+		{name: "bounded", walk: RandomWalk{Start: 2000, Min: 1000, Max: 3000, MaxChange: 500, Duration: 60000, StepMs: 100, Seed: 1}},
+		{name: "max change of the whole range", walk: RandomWalk{Start: 1, Min: 1, Max: 1 << 62, MaxChange: 1<<62 - 1, Duration: 60000, StepMs: 100, Seed: 2}},
+		{name: "huge range", walk: RandomWalk{Start: 1, Min: 1, Max: 1<<63 - 1, MaxChange: 1<<63 - 2, Duration: 60000, StepMs: 100, Seed: 3}},
+		{name: "constant", walk: RandomWalk{Start: 1000, Min: 1000, Max: 1000, Duration: 5000, Seed: 4}},
+		{name: "max change above range", walk: RandomWalk{Start: 1000, Min: 1000, Max: 2000, MaxChange: 1001, Duration: 5000}, wantErr: true},
+		{name: "max change overflowing", walk: RandomWalk{Start: 1, Min: 1, Max: 2, MaxChange: 1 << 62, Duration: 5000}, wantErr: true},
+		{name: "start out of range", walk: RandomWalk{Start: 500, Min: 1000, Max: 2000, Duration: 5000}, wantErr: true},
+		{name: "min NOT positive", walk: RandomWalk{Start: 0, Min: 0, Max: 2000, Duration: 5000}, wantErr: true},
+		{name: "no duration", walk: RandomWalk{Start: 1000, Min: 1000, Max: 2000}, wantErr: true},
+		{name: "too many steps", walk: RandomWalk{Start: 1000, Min: 1000, Max: 2000, Duration: TRACE_MAX_STEPS + 1, StepMs: 1}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.walk.Generate()
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %d steps", len(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			durationMs := uint64(0)
+			for i, step := range got {
+				if step.Speed < test.walk.Min || step.Speed > test.walk.Max {
+					t.Fatalf("step %d speed %d out of [%d, %d]", i, step.Speed, test.walk.Min, test.walk.Max)
+				}
+				if i > 0 {
+					change := step.Speed - got[i-1].Speed
+					if change > test.walk.MaxChange || -change > test.walk.MaxChange {
+						t.Fatalf("step %d changed %d, max: %d", i, change, test.walk.MaxChange)
+					}
+				}
+				durationMs += step.Duration
+			}
+			if got[0].Speed != test.walk.Start || durationMs != test.walk.Duration {
+				t.Fatalf("starts at %d lasting %dms, want %d lasting %dms", got[0].Speed, durationMs, test.walk.Start, test.walk.Duration)
+			}
+
+			// Same seed, same trajectory
+			again, _ := test.walk.Generate()
+			if !slices.Equal(got, again) {
+				t.Fatal("same seed generated a different trajectory")
+			}
+		})
+	}
+}
@@ -9,14 +9,26 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"facebookexperimental/moq-go-server/awt"
+	"facebookexperimental/moq-go-server/moqabr"
+	"facebookexperimental/moq-go-server/moqauth"
+	"facebookexperimental/moq-go-server/moqcatalog"
 	"facebookexperimental/moq-go-server/moqconnectionmanagment"
+	"facebookexperimental/moq-go-server/moqdvr"
+	"facebookexperimental/moq-go-server/moqencoder"
 	"facebookexperimental/moq-go-server/moqfwdtable"
 	"facebookexperimental/moq-go-server/moqmessageobjects"
+	"facebookexperimental/moq-go-server/moqquota"
+	"facebookexperimental/moq-go-server/moqtrackpolicy"
 	"flag"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/quic-go/quic-go"
@@ -34,9 +46,22 @@ const TLS_CERT_FILEPATH = "../../cert/localhost.pem"
 const TLS_KEY_FILEPATH = "../../cert/localhost-key.pem"
 const OBJECT_EXPIRATION_MS = 3 * 60 * 1000
 const CACHE_CLEAN_UP_PERIOD_MS = 10 * 1000
+const CACHE_MAX_BYTES = 0
+const CACHE_TRACK_MAX_BYTES = 0
+const CACHE_DISK_MAX_BYTES = 10 * 1024 * 1024 * 1024
+const CACHE_DISK_MAX_AGE_MS = 60 * 60 * 1000
 const HTTP_CONNECTION_KEEP_ALIVE_MS = 10 * 1000
+const SUBSCRIPTION_MAX_EXPIRES_MS = 0
+const SUBSCRIPTION_CATCH_UP_GROUPS = 0
+const SUBSCRIPTION_CACHE_ONLY_EXPIRES_MS = 10 * 1000
 const STATIC_DIRECTORY = "../../moq-client"
 const DATA_DIRECTORY = "../../data"
+const AUTH_MODE = "none"
+const AUTH_KEYS_RELOAD_PERIOD_MS = 60 * 1000
+const DVR_REPLAY_SPEED = 1.0
+const ENCODER_TIMEOUT_MS = 5 * 1000
+const ENCODER_MAX_PROCESSES = 8
+const STATS_INTERVAL_MS = 1000
 
 func main() {
 	// Parse params
@@ -45,22 +70,62 @@ func main() {
 	tlsKeyPath := flag.String("tls_key", TLS_KEY_FILEPATH, "TLS key file path to use in this server")
 	objExpMs := flag.Uint64("obj_exp_ms", OBJECT_EXPIRATION_MS, "Object TTL in this server (in milliseconds)")
 	cacheCleanUpPeriodMs := flag.Uint64("cache_cleanup_period_ms", CACHE_CLEAN_UP_PERIOD_MS, "Execute clean up task every (in milliseconds)")
+	cacheMaxBytes := flag.Uint64("cache_max_bytes", CACHE_MAX_BYTES, "Object cache byte budget, least recently used objects are evicted over it (0 means no limit)")
+	cacheTrackMaxBytes := flag.Uint64("cache_track_max_bytes", CACHE_TRACK_MAX_BYTES, "Object cache byte budget per track (0 means no limit)")
+	cacheDisk := flag.Bool("cache_disk", false, "Spill completed objects evicted or expired from memory to disk (under data directory)")
+	cacheDiskMaxBytes := flag.Uint64("cache_disk_max_bytes", CACHE_DISK_MAX_BYTES, "Disk tier byte budget (0 means no limit)")
+	cacheDiskMaxAgeMs := flag.Uint64("cache_disk_max_age_ms", CACHE_DISK_MAX_AGE_MS, "Disk tier object TTL (in milliseconds, 0 means no limit)")
+	cacheSnapshot := flag.Bool("cache_snapshot", false, "Save completed cached objects on graceful shutdown (SIGINT / SIGTERM) and load them at startup (under data directory)")
 	httpConnTimeoutMs := flag.Uint64("http_conn_time_out_ms", HTTP_CONNECTION_KEEP_ALIVE_MS, "HTTP connection timeout (in milliseconds)")
+	subCatchUpGroups := flag.Uint64("sub_catch_up_groups", SUBSCRIPTION_CATCH_UP_GROUPS, "Latest groups held in the cache sent to new subscriptions before the live objects, 0 means none (only live objects)")
+	subCacheOnlyExpiresMs := flag.Uint64("sub_cache_only_expires_ms", SUBSCRIPTION_CACHE_ONLY_EXPIRES_MS, "Expiry of subscriptions answered from the cache while the track has no publisher (ex: after a restart with a cache snapshot)")
+	subMaxExpiresMs := flag.Uint64("sub_max_expires_ms", SUBSCRIPTION_MAX_EXPIRES_MS, "Max subscription expiry granted to subscribers, 0 means use the publisher one (in milliseconds)")
 	staticDir := flag.String("static", STATIC_DIRECTORY, "path to directory to host static files")
 	dataDir := flag.String("data", DATA_DIRECTORY, "path to data directory for output")
+	qlogKeep := flag.Bool("qlog_keep", false, "Keep qlog files of previous runs (by default the qlog directory is cleared at startup)")
+	authMode := flag.String("auth", AUTH_MODE, "Authorization mode: none, static, acl, signed")
+	authPublishToken := flag.String("auth_publish_token", "", "Token publishers need to present (static auth mode, empty means open)")
+	authSubscribeToken := flag.String("auth_subscribe_token", "", "Token subscribers need to present (static auth mode, empty means open)")
+	authAclPath := flag.String("auth_acl", "", "ACL file path (acl auth mode)")
+	authKeysDir := flag.String("auth_keys", "", "Directory with token keys, <kid>.key (HMAC secret) or <kid>.pub (Ed25519 PEM) (signed auth mode)")
+	authKeysReloadMs := flag.Uint64("auth_keys_reload_ms", AUTH_KEYS_RELOAD_PERIOD_MS, "Reload token keys every (in milliseconds), 0 means never")
+	quotasPath := flag.String("quotas", "", "Per tenant quotas file path (empty means default limits)")
+	dvrRecordNs := flag.String("dvr_record_ns", "", "Comma separated namespace patterns (\"*\" at the end matches any suffix) to record under data directory (empty means no recording)")
+	dvrRecordTracks := flag.String("dvr_record_tracks", "", "Comma separated track name patterns to record (empty means all tracks of the recorded namespaces)")
+	dvrReplay := flag.String("dvr_replay", "", "Comma separated recording directories to replay as publishers")
+	dvrReplaySpeed := flag.Float64("dvr_replay_speed", DVR_REPLAY_SPEED, "Replay pacing factor, 2 means twice as fast as recorded (0 means no pacing, NOT allowed with -dvr_replay_loop)")
+	dvrReplayLoop := flag.Bool("dvr_replay_loop", false, "Restart replays after the last object")
+	encoderCmd := flag.String("encoder_cmd", "", "Command line of the external encoder (\"external\" in the track policy), payload is sent to stdin and the rendition read from stdout. Placeholders: {bitrate}, {maxrate}, {bufsize}, {resolution}")
+	encoderTimeoutMs := flag.Uint64("encoder_timeout_ms", ENCODER_TIMEOUT_MS, "Max duration of every external encoder run, including the wait for a free process slot (in milliseconds, 0 means no limit)")
+	encoderMaxProcesses := flag.Int("encoder_max_processes", ENCODER_MAX_PROCESSES, "Max external encoder processes running at the same time, the rest wait for a free slot")
+	trackPolicyPath := flag.String("track_policy", "", "Track policy file path, sets opaque / loc mode per namespace and track (empty means all loc)")
+	abrPolicySpec := flag.String("abr_policy", moqabr.DEFAULT_POLICY, "Default server side ABR policy: etp, rate, bola or fixed:<bitrate> (subscribers can override it with a SUBSCRIBE parameter)")
+	throughputEstimator := flag.String("throughput_estimator", awt.DEFAULT_ESTIMATOR, "Throughput estimator of the ETP: stream, ewma, window or cwnd")
+	throughputLogPath := flag.String("throughput_log", "", "CSV file where the estimates of every throughput estimator are appended, to compare them (empty means none)")
+	statsIntervalMs := flag.Uint64("stats_interval_ms", STATS_INTERVAL_MS, "Send a report (ETP, RTT, queue depth and renditions) on the stats track of subscribers every (in milliseconds), 0 means never")
 	flag.Parse()
 
 	var (
 		err          error
 		tlsCert      tls.Certificate
-		allQlogPaths []string
+		connStats    *awt.ConnectionStatsRegistry
+		estimatesLog *awt.EstimatesLog
+		shapers      *awt.ShaperRegistry = awt.NewShaperRegistry()
+		authorizer   moqauth.Authorizer
+		signedTokens *moqauth.SignedTokenAuthorizer
+		quotas       *moqquota.MoqQuotas            = moqquota.New()
+		trackPolicy  *moqtrackpolicy.MoqTrackPolicy = moqtrackpolicy.New()
+		recorder     *moqdvr.Recorder
+		abrPolicy    moqabr.ABRPolicy
 	)
 
 	log.SetFormatter(&log.TextFormatter{})
 
-	if err = awt.ClearQlogDirectory(*dataDir); err != nil {
-		log.Error(fmt.Sprintf("qlog dir: %s\n", err))
-		return
+	if !*qlogKeep {
+		if err = awt.ClearQlogDirectory(*dataDir); err != nil {
+			log.Error(fmt.Sprintf("qlog dir: %s\n", err))
+			return
+		}
 	}
 
 	if tlsCert, err = tls.LoadX509KeyPair(*tlsCertPath, *tlsKeyPath); err != nil {
@@ -68,11 +133,107 @@ func main() {
 		return
 	}
 
+	switch *authMode {
+	case "none":
+		authorizer = moqauth.NewAllowAll()
+	case "static":
+		authorizer = moqauth.NewStaticToken(*authPublishToken, *authSubscribeToken)
+	case "acl":
+		if authorizer, err = moqauth.NewAclFromFile(*authAclPath); err != nil {
+			log.Error(fmt.Sprintf("auth: %s\n", err))
+			return
+		}
+	case "signed":
+		if signedTokens, err = moqauth.NewSignedTokenFromDir(*authKeysDir, *authKeysReloadMs); err != nil {
+			log.Error(fmt.Sprintf("auth: %s\n", err))
+			return
+		}
+		authorizer = signedTokens
+	default:
+		log.Error(fmt.Sprintf("auth: invalid mode %s\n", *authMode))
+		return
+	}
+
+	if *quotasPath != "" {
+		if quotas, err = moqquota.NewFromFile(*quotasPath); err != nil {
+			log.Error(fmt.Sprintf("quotas: %s\n", err))
+			return
+		}
+	}
+
+	encoders := moqencoder.NewRegistry()
+	if *encoderCmd != "" {
+		var externalEncoder *moqencoder.ExternalProcessEncoder
+		if externalEncoder, err = moqencoder.NewExternalProcess(moqencoder.EXTERNAL_PROCESS_NAME, *encoderCmd, time.Duration(*encoderTimeoutMs)*time.Millisecond, *encoderMaxProcesses); err == nil {
+			err = encoders.Register(externalEncoder)
+		}
+		if err != nil {
+			log.Error(fmt.Sprintf("encoder: %s\n", err))
+			return
+		}
+	}
+
+	if *throughputLogPath != "" {
+		if estimatesLog, err = awt.NewEstimatesLog(*throughputLogPath); err != nil {
+			log.Error(fmt.Sprintf("throughput log: %s\n", err))
+			return
+		}
+		defer estimatesLog.Close()
+	}
+	if connStats, err = awt.NewConnectionStatsRegistry(*throughputEstimator, estimatesLog); err != nil {
+		log.Error(fmt.Sprintf("throughput estimator: %s\n", err))
+		return
+	}
+
+	if abrPolicy, err = moqabr.New(*abrPolicySpec); err != nil {
+		log.Error(fmt.Sprintf("abr: %s\n", err))
+		return
+	}
+
+	if *trackPolicyPath != "" {
+		if trackPolicy, err = moqtrackpolicy.NewFromFile(*trackPolicyPath, encoders); err != nil {
+			log.Error(fmt.Sprintf("track policy: %s\n", err))
+			return
+		}
+	}
+
 	// Create moqt obj forward table
-	moqtFwdTable := moqfwdtable.New()
+	moqtFwdTable := moqfwdtable.New(*subMaxExpiresMs)
 
 	// create objects mem storage (relay)
-	objects := moqmessageobjects.New(*cacheCleanUpPeriodMs)
+	objects := moqmessageobjects.New(*cacheCleanUpPeriodMs, *cacheMaxBytes, *cacheTrackMaxBytes)
+	if *cacheDisk {
+		if err = objects.EnableDiskTier(fmt.Sprintf("%s/cache", *dataDir), *cacheDiskMaxBytes, *cacheDiskMaxAgeMs); err != nil {
+			log.Error(fmt.Sprintf("disk tier: %s\n", err))
+			return
+		}
+	}
+	snapshotDir := fmt.Sprintf("%s/snapshot", *dataDir)
+	if *cacheSnapshot {
+		if _, err = objects.LoadSnapshot(snapshotDir); err != nil {
+			log.Error(fmt.Sprintf("cache snapshot: %s\n", err))
+			return
+		}
+	}
+
+	// Catalog track of every namespace, generated from the tracks seen at ingest
+	catalog := moqcatalog.New(objects, moqtFwdTable, trackPolicy, *objExpMs)
+
+	if *dvrRecordNs != "" {
+		if recorder, err = moqdvr.NewRecorder(fmt.Sprintf("%s/recordings", *dataDir), splitList(*dvrRecordNs), splitList(*dvrRecordTracks)); err != nil {
+			log.Error(fmt.Sprintf("dvr: %s\n", err))
+			return
+		}
+	}
+	replays := []*moqdvr.Replay{}
+	for _, replayDir := range splitList(*dvrReplay) {
+		replay, err := moqdvr.StartReplay(replayDir, *dvrReplaySpeed, *dvrReplayLoop, moqtFwdTable, objects, *objExpMs, trackPolicy, catalog)
+		if err != nil {
+			log.Error(fmt.Sprintf("dvr replay %s: %s\n", replayDir, err))
+			return
+		}
+		replays = append(replays, replay)
+	}
 
 	server := &webtransport.Server{
 		H3: http3.Server{
@@ -89,9 +250,14 @@ func main() {
 						panic(e)
 					}
 
-					allQlogPaths = append(allQlogPaths, path)
+					// In memory stats (ETP) for the session, the qlog file is kept for offline analysis
+					statsTracer, e := connStats.NewTracer(ctx)
+					if e != nil {
+						log.Error(fmt.Sprintf("tracer: %s\n", e))
+						return qlog.NewConnectionTracer(fp, p, ci)
+					}
 
-					return qlog.NewConnectionTracer(fp, p, ci)
+					return logging.NewMultiplexedConnectionTracer(qlog.NewConnectionTracer(fp, p, ci), statsTracer)
 				},
 				MaxIdleTimeout: time.Duration(*httpConnTimeoutMs) * time.Millisecond,
 			},
@@ -106,8 +272,9 @@ func main() {
 
 	http.HandleFunc("/moq", func(rw http.ResponseWriter, r *http.Request) {
 		var (
-			session  *webtransport.Session
-			qlogPath string
+			session *webtransport.Session
+			stats   *awt.ConnectionStats
+			err     error
 		)
 
 		if session, err = server.Upgrade(rw, r); err != nil {
@@ -115,24 +282,71 @@ func main() {
 			return
 		}
 
-		if qlogPath, err = awt.GetQlogPath(session, &allQlogPaths); err != nil {
-			log.Error(fmt.Sprintf("tls: %s\n", err))
+		if stats, err = connStats.Get(session); err != nil {
+			log.Error(fmt.Sprintf("connection stats: %s\n", err))
 			return
 		}
 
 		namespace := r.URL.Path
-		log.Info(fmt.Sprintf("%s - Accepted incoming WebTransport session. rawQuery: %s", namespace, r.URL.RawQuery))
+		log.Info(fmt.Sprintf("%s - Accepted incoming WebTransport session. rawQuery: %s", namespace, redactQuery(r.URL.Query())))
 
-		moqconnectionmanagment.MoqConnectionManagment(session, namespace, moqtFwdTable, objects, *objExpMs, qlogPath)
+		moqconnectionmanagment.MoqConnectionManagment(session, namespace, r.URL.Query(), moqtFwdTable, objects, *objExpMs, stats, authorizer, quotas, trackPolicy, recorder, catalog, abrPolicy, *statsIntervalMs, shapers, *subCatchUpGroups, *subCacheOnlyExpiresMs)
 	})
 
-	go awt.ServeHTTP(*staticDir)
+	go awt.ServeHTTP(*staticDir, func(trackNamespace string, trackName string) awt.EncoderLadder {
+		return trackPolicy.LadderFor(trackPolicy.ModeFor(trackNamespace, trackName), trackNamespace, trackName)
+	}, shapers)
+
+	// Graceful shutdown
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Info(fmt.Sprintf("Received %s, shutting down", sig))
+		server.Close()
+	}()
 
 	log.Info("Launching WebTransport server at: ", server.H3.Addr)
-	if err := server.ListenAndServe(); err != nil {
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Error(fmt.Sprintf("Server error: %s", err))
 		return
 	}
 
+	for _, replay := range replays {
+		replay.Stop()
+	}
+	if recorder != nil {
+		recorder.Stop()
+	}
+	if signedTokens != nil {
+		signedTokens.Stop()
+	}
+	if *cacheSnapshot {
+		if _, err = objects.SaveSnapshot(snapshotDir); err != nil {
+			log.Error(fmt.Sprintf("cache snapshot: %s\n", err))
+		}
+	}
 	objects.Stop()
 }
+
+// Splits a comma separated flag, empty items are ignored
+func splitList(value string) (items []string) {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+// Hides credentials from logs
+func redactQuery(query url.Values) string {
+	redacted := url.Values{}
+	for k, v := range query {
+		redacted[k] = v
+	}
+	if redacted.Has(moqauth.TOKEN_QUERY_PARAM) {
+		redacted.Set(moqauth.TOKEN_QUERY_PARAM, "REDACTED")
+	}
+	return redacted.Encode()
+}
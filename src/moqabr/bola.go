@@ -0,0 +1,52 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqabr
+
+import (
+	"math"
+)
+
+// Defaults: subscriber queue (objects) that counts as an empty player buffer, and gamma*p of BOLA
+const (
+	BOLA_QUEUE_MAX = 8
+	BOLA_GP        = 5.0
+)
+
+// Buffer based (BOLA style). The relay does NOT know the player buffer, the subscriber queue stands for it:
+// an empty queue is a full buffer (highest quality), a queue of queueMax objects or more an empty one
+type BolaPolicy struct {
+	queueMax int
+	gp       float64
+}
+
+func NewBola(queueMax int, gp float64) *BolaPolicy {
+	return &BolaPolicy{queueMax: queueMax, gp: gp}
+}
+
+func (p *BolaPolicy) Name() string {
+	return BOLA_NAME
+}
+
+// Maximizes (V * (utility + gp) - buffer) / bitrate, utility = ln(bitrate / lowest bitrate)
+func (p *BolaPolicy) Choose(bitrates []uint64, in Input) uint64 {
+	lowest := float64(max(bitrates[0], 1))
+	utilityMax := math.Log(float64(max(bitrates[len(bitrates)-1], 1)) / lowest)
+	v := float64(p.queueMax-1) / (utilityMax + p.gp)
+	buffer := float64(max(0, p.queueMax-in.QueueDepth))
+
+	chosen := bitrates[0]
+	bestScore := math.Inf(-1)
+	for _, bitrate := range bitrates {
+		size := float64(max(bitrate, 1))
+		score := (v*(math.Log(size/lowest)+p.gp) - buffer) / size
+		if score > bestScore {
+			chosen = bitrate
+			bestScore = score
+		}
+	}
+	return chosen
+}
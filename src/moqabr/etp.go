@@ -0,0 +1,25 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqabr
+
+// Highest rendition that fits the latest ETP sample (no smoothing)
+type EtpPolicy struct{}
+
+func NewEtp() *EtpPolicy {
+	return &EtpPolicy{}
+}
+
+func (p *EtpPolicy) Name() string {
+	return ETP_NAME
+}
+
+func (p *EtpPolicy) Choose(bitrates []uint64, in Input) uint64 {
+	if len(in.ETPHistory) <= 0 {
+		return bitrates[0]
+	}
+	return highestFitting(bitrates, float64(in.ETPHistory[len(in.ETPHistory)-1]))
+}
@@ -0,0 +1,24 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqabr
+
+// Always the highest rendition <= bitrate (the lowest one if none fits)
+type FixedPolicy struct {
+	bitrate uint64
+}
+
+func NewFixed(bitrate uint64) *FixedPolicy {
+	return &FixedPolicy{bitrate: bitrate}
+}
+
+func (p *FixedPolicy) Name() string {
+	return FIXED_NAME
+}
+
+func (p *FixedPolicy) Choose(bitrates []uint64, in Input) uint64 {
+	return highestFitting(bitrates, float64(p.bitrate))
+}
@@ -0,0 +1,82 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqabr
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of the built in policies
+const (
+	ETP_NAME   = "etp"
+	RATE_NAME  = "rate"
+	BOLA_NAME  = "bola"
+	FIXED_NAME = "fixed"
+)
+
+// Highest rendition <= ETP, as before policies were pluggable
+const DEFAULT_POLICY = ETP_NAME
+
+// What a policy knows when choosing the rendition of the next object of a subscription
+type Input struct {
+	// Throughput samples in kbps, oldest first
+	ETPHistory []uint64
+	// Smoothed RTT of the connection (0 if unknown)
+	RTT time.Duration
+	// Objects of the subscriber waiting to be sent
+	QueueDepth int
+	// Bitrate of the previous object of the subscription (0 if none)
+	Current uint64
+	// The object is the first of its group
+	GroupStart bool
+}
+
+// ABRPolicy chooses the rendition sent to a subscriber (server side ABR). State is kept by the
+// caller (Input), so a policy can be shared by every subscription
+type ABRPolicy interface {
+	Name() string
+	// Picks one of bitrates (ascending, NOT empty) for the next object
+	Choose(bitrates []uint64, in Input) uint64
+}
+
+// Creates a policy from its spec: "etp", "rate", "bola" or "fixed:<bitrate>"
+func New(spec string) (policy ABRPolicy, err error) {
+	name, param, _ := strings.Cut(spec, ":")
+	switch name {
+	case ETP_NAME:
+		policy = NewEtp()
+	case RATE_NAME:
+		policy = NewRateHysteresis(RATE_WINDOW, RATE_SAFETY)
+	case BOLA_NAME:
+		policy = NewBola(BOLA_QUEUE_MAX, BOLA_GP)
+	case FIXED_NAME:
+		var bitrate uint64
+		if bitrate, err = strconv.ParseUint(param, 10, 64); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid fixed ABR bitrate %s, err: %v", param, err))
+		}
+		policy = NewFixed(bitrate)
+	default:
+		err = errors.New(fmt.Sprintf("Unknown ABR policy %s", spec))
+	}
+	return
+}
+
+// Highest bitrate <= limit, the lowest one if none fits
+func highestFitting(bitrates []uint64, limit float64) uint64 {
+	chosen := bitrates[0]
+	for _, bitrate := range bitrates {
+		if float64(bitrate) > limit {
+			break
+		}
+		chosen = bitrate
+	}
+	return chosen
+}
@@ -0,0 +1,121 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqabr
+
+import (
+	"testing"
+)
+
+var testBitrates = []uint64{500, 1000, 2000, 4000}
+
+func TestRateHysteresisPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		in   Input
+		want uint64
+	}{
+		{name: "no samples, first object", in: Input{}, want: 500},
+		{name: "no samples, keeps current", in: Input{Current: 2000}, want: 2000},
+		{name: "only samples without estimate", in: Input{ETPHistory: []uint64{0, 0}, Current: 1000}, want: 1000},
+		{name: "samples without estimate skipped", in: Input{ETPHistory: []uint64{0, 3000, 0}}, want: 2000},
+		{name: "switches up with safety", in: Input{ETPHistory: []uint64{3000}, Current: 1000}, want: 2000},
+		{name: "stays inside the band", in: Input{ETPHistory: []uint64{2200}, Current: 2000}, want: 2000},
+		{name: "switches down out of the band", in: Input{ETPHistory: []uint64{1500}, Current: 2000}, want: 1000},
+		{name: "single high sample barely moves it", in: Input{ETPHistory: []uint64{1000, 10000}, Current: 1000}, want: 1000},
+		{name: "only the latest window", in: Input{ETPHistory: []uint64{100, 100, 100, 100, 100, 5000, 5000, 5000, 5000, 5000}, Current: 500}, want: 4000},
+		{name: "current NOT in the ladder", in: Input{ETPHistory: []uint64{1500}, Current: 3000}, want: 1000},
+		{name: "nothing fits", in: Input{ETPHistory: []uint64{100}, Current: 1000}, want: 500},
+	}
+
+	policy := NewRateHysteresis(RATE_WINDOW, RATE_SAFETY)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := policy.Choose(testBitrates, test.in); got != test.want {
+				t.Fatalf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBolaPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		bitrates []uint64
+		in       Input
+		want     uint64
+	}{
+		{name: "empty queue", bitrates: testBitrates, in: Input{QueueDepth: 0}, want: 4000},
+		{name: "full queue", bitrates: testBitrates, in: Input{QueueDepth: BOLA_QUEUE_MAX}, want: 500},
+		{name: "queue over max", bitrates: testBitrates, in: Input{QueueDepth: 10 * BOLA_QUEUE_MAX}, want: 500},
+		{name: "ignores ETP", bitrates: testBitrates, in: Input{ETPHistory: []uint64{100}, QueueDepth: 0}, want: 4000},
+		{name: "single bitrate, empty queue", bitrates: []uint64{1000}, in: Input{QueueDepth: 0}, want: 1000},
+		{name: "single bitrate, full queue", bitrates: []uint64{1000}, in: Input{QueueDepth: BOLA_QUEUE_MAX}, want: 1000},
+		{name: "zero bitrate", bitrates: []uint64{0, 1000}, in: Input{QueueDepth: BOLA_QUEUE_MAX}, want: 0},
+	}
+
+	policy := NewBola(BOLA_QUEUE_MAX, BOLA_GP)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := policy.Choose(test.bitrates, test.in); got != test.want {
+				t.Fatalf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+
+	// Higher queues never pick higher bitrates
+	prev := uint64(0)
+	for depth := BOLA_QUEUE_MAX; depth >= 0; depth-- {
+		got := policy.Choose(testBitrates, Input{QueueDepth: depth})
+		if got < prev {
+			t.Fatalf("queue %d got %d, lower than %d with a longer queue", depth, got, prev)
+		}
+		prev = got
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		spec     string
+		wantName string
+		// Choice with testBitrates and an ETP of 1500
+		want    uint64
+		wantErr bool
+	}{
+		{spec: ETP_NAME, wantName: ETP_NAME, want: 1000},
+		{spec: RATE_NAME, wantName: RATE_NAME, want: 1000},
+		{spec: BOLA_NAME, wantName: BOLA_NAME, want: 4000},
+		{spec: "fixed:2500", wantName: FIXED_NAME, want: 2000},
+		{spec: "fixed:100", wantName: FIXED_NAME, want: 500},
+		{spec: DEFAULT_POLICY, wantName: ETP_NAME, want: 1000},
+		{spec: "fixed", wantErr: true},
+		{spec: "fixed:abc", wantErr: true},
+		{spec: "fixed:-1", wantErr: true},
+		{spec: "dynamic", wantErr: true},
+		{spec: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			policy, err := New(test.spec)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %s", policy.Name())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if policy.Name() != test.wantName {
+				t.Fatalf("got %s, want %s", policy.Name(), test.wantName)
+			}
+			if got := policy.Choose(testBitrates, Input{ETPHistory: []uint64{1500}}); got != test.want {
+				t.Fatalf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqabr
+
+import (
+	"slices"
+)
+
+// Samples and fraction of the estimate used to switch up
+const (
+	RATE_WINDOW = 5
+	RATE_SAFETY = 0.8
+)
+
+// Rate based with hysteresis: the estimate is the harmonic mean of the latest samples (a single
+// high sample barely moves it), it switches up only if the new rendition fits safety * estimate
+// and down only when the current one does NOT fit the estimate anymore
+type RateHysteresisPolicy struct {
+	window int
+	safety float64
+}
+
+func NewRateHysteresis(window int, safety float64) *RateHysteresisPolicy {
+	return &RateHysteresisPolicy{window: window, safety: safety}
+}
+
+func (p *RateHysteresisPolicy) Name() string {
+	return RATE_NAME
+}
+
+func (p *RateHysteresisPolicy) Choose(bitrates []uint64, in Input) uint64 {
+	estimate, ok := harmonicMean(in.ETPHistory[max(0, len(in.ETPHistory)-p.window):])
+	if !ok {
+		if slices.Contains(bitrates, in.Current) {
+			return in.Current
+		}
+		return bitrates[0]
+	}
+
+	target := highestFitting(bitrates, p.safety*estimate)
+	if !slices.Contains(bitrates, in.Current) || target > in.Current {
+		return target
+	}
+	if float64(in.Current) <= estimate {
+		// Inside the hysteresis band
+		return in.Current
+	}
+	return target
+}
+
+func harmonicMean(samples []uint64) (mean float64, ok bool) {
+	sum := 0.0
+	n := 0
+	for _, sample := range samples {
+		// No estimate (ex: single packet objects)
+		if sample == 0 {
+			continue
+		}
+		sum += 1 / float64(sample)
+		n++
+	}
+	if n <= 0 {
+		return 0, false
+	}
+	return float64(n) / sum, true
+}
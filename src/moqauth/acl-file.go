@@ -0,0 +1,99 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqauth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"fmt"
+	"os"
+)
+
+// ACL file entry, an empty token applies to sessions without token
+// Example: [{"token": "abc", "publish": ["org/event/*"], "subscribe": ["org/*"], "tenant": "org"}]
+type AclEntry struct {
+	Token     string   `json:"token"`
+	Publish   []string `json:"publish"`
+	Subscribe []string `json:"subscribe"`
+	Tenant    string   `json:"tenant,omitempty"`
+}
+
+type AclAuthorizer struct {
+	entries []AclEntry
+}
+
+func NewAclFromFile(path string) (a *AclAuthorizer, err error) {
+	var (
+		buf     []byte
+		entries []AclEntry
+	)
+
+	if buf, err = os.ReadFile(path); err != nil {
+		return
+	}
+	if err = json.Unmarshal(buf, &entries); err != nil {
+		err = errors.New(fmt.Sprintf("Parsing ACL file %s, err: %v", path, err))
+		return
+	}
+
+	a = &AclAuthorizer{entries: entries}
+	return
+}
+
+func (a *AclAuthorizer) AuthorizeSetup(session SessionInfo) Result {
+	entry, result := a.findEntry(session.Token())
+	if !result.Allowed {
+		return result
+	}
+	if len(entry.patterns(session.Role)) <= 0 {
+		return Deny(ReasonRoleNotAllowed, "Role not allowed")
+	}
+	result.Tenant = entry.Tenant
+	return result
+}
+
+func (a *AclAuthorizer) AuthorizeAnnounce(session SessionInfo, announce moqhelpers.MoqMessageAnnounce) Result {
+	return a.check(moqhelpers.MoqRolePublisher, session.MessageToken(announce.AuthInfo), announce.TrackNamespace)
+}
+
+func (a *AclAuthorizer) AuthorizeSubscribe(session SessionInfo, subscribe moqhelpers.MoqMessageSubscribe) Result {
+	return a.check(moqhelpers.MoqRoleSubscriber, session.MessageToken(subscribe.AuthInfo), subscribe.TrackNamespace)
+}
+
+func (a *AclAuthorizer) check(role moqhelpers.MoqRole, token string, trackNamespace string) Result {
+	entry, result := a.findEntry(token)
+	if !result.Allowed {
+		return result
+	}
+	for _, pattern := range entry.patterns(role) {
+		if MatchNamespace(pattern, trackNamespace) {
+			return Allow()
+		}
+	}
+	return Deny(ReasonNamespaceForbidden, fmt.Sprintf("Namespace %s not allowed", trackNamespace))
+}
+
+func (a *AclAuthorizer) findEntry(token string) (entry AclEntry, result Result) {
+	for _, e := range a.entries {
+		if subtle.ConstantTimeCompare([]byte(e.Token), []byte(token)) == 1 {
+			return e, Allow()
+		}
+	}
+	if token == "" {
+		return entry, Deny(ReasonMissingCredentials, "Missing token")
+	}
+	return entry, Deny(ReasonInvalidCredentials, "Invalid token")
+}
+
+func (e *AclEntry) patterns(role moqhelpers.MoqRole) []string {
+	if role == moqhelpers.MoqRolePublisher {
+		return e.Publish
+	}
+	return e.Subscribe
+}
@@ -0,0 +1,138 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqauth
+
+import (
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"net/url"
+	"strings"
+)
+
+// URL query parameter that can carry the session token
+const TOKEN_QUERY_PARAM = "token"
+
+type Reason uint
+
+const (
+	ReasonAllowed            Reason = 0x0
+	ReasonMissingCredentials Reason = 0x1
+	ReasonInvalidCredentials Reason = 0x2
+	ReasonRoleNotAllowed     Reason = 0x3
+	ReasonNamespaceForbidden Reason = 0x4
+)
+
+// Result of an authorization check
+type Result struct {
+	Allowed bool
+	Reason  Reason
+	Msg     string
+
+	// Tenant the credentials belong to (if known)
+	Tenant string
+}
+
+// Info about the WebTransport session that is being authorized
+type SessionInfo struct {
+	// WebTransport URL path
+	Path string
+	// WebTransport URL query
+	Query url.Values
+	// Role from SETUP
+	Role moqhelpers.MoqRole
+	// Authorization info parameter from SETUP (if any)
+	AuthInfo string
+}
+
+// Authorizer is consulted at session setup, on every ANNOUNCE and on every SUBSCRIBE
+type Authorizer interface {
+	AuthorizeSetup(session SessionInfo) Result
+	AuthorizeAnnounce(session SessionInfo, announce moqhelpers.MoqMessageAnnounce) Result
+	AuthorizeSubscribe(session SessionInfo, subscribe moqhelpers.MoqMessageSubscribe) Result
+}
+
+func Allow() Result {
+	return Result{Allowed: true, Reason: ReasonAllowed}
+}
+
+func Deny(reason Reason, msg string) Result {
+	return Result{Allowed: false, Reason: reason, Msg: msg}
+}
+
+// Token presented for the session, SETUP authorization info has precedence over the URL query
+func (si SessionInfo) Token() string {
+	if si.AuthInfo != "" {
+		return si.AuthInfo
+	}
+	if si.Query != nil {
+		return si.Query.Get(TOKEN_QUERY_PARAM)
+	}
+	return ""
+}
+
+// Token presented for a message, falls back to the session one
+func (si SessionInfo) MessageToken(msgAuthInfo string) string {
+	if msgAuthInfo != "" {
+		return msgAuthInfo
+	}
+	return si.Token()
+}
+
+func (r Result) SessionErrorCode() moqhelpers.MoqErrorCode {
+	if r.Allowed {
+		return moqhelpers.NoError
+	}
+	return moqhelpers.ErrorUnauthorized
+}
+
+func (r Result) AnnounceErrorCode() moqhelpers.MoqErrorCodeAnnounce {
+	switch r.Reason {
+	case ReasonAllowed:
+		return moqhelpers.NoErrorAnnounce
+	case ReasonMissingCredentials, ReasonInvalidCredentials:
+		return moqhelpers.ErrorAnnounceUnauthorized
+	default:
+		return moqhelpers.ErrorAnnounceForbidden
+	}
+}
+
+func (r Result) SubscribeErrorCode() moqhelpers.MoqErrorCodeSubscribe {
+	switch r.Reason {
+	case ReasonAllowed:
+		return moqhelpers.NoErrorSubscribe
+	case ReasonMissingCredentials, ReasonInvalidCredentials:
+		return moqhelpers.ErrorSubscribeUnauthorized
+	default:
+		return moqhelpers.ErrorSubscribeForbidden
+	}
+}
+
+// Matches namespace against pattern, "*" at the end of the pattern matches any suffix
+func MatchNamespace(pattern string, trackNamespace string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(trackNamespace, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == trackNamespace
+}
+
+// Allows everything (default)
+type allowAll struct{}
+
+func NewAllowAll() Authorizer {
+	return allowAll{}
+}
+
+func (allowAll) AuthorizeSetup(session SessionInfo) Result {
+	return Allow()
+}
+
+func (allowAll) AuthorizeAnnounce(session SessionInfo, announce moqhelpers.MoqMessageAnnounce) Result {
+	return Allow()
+}
+
+func (allowAll) AuthorizeSubscribe(session SessionInfo, subscribe moqhelpers.MoqMessageSubscribe) Result {
+	return Allow()
+}
@@ -0,0 +1,315 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqauth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Key files in the keys directory, the file name (without extension) is the key id (kid)
+const HMAC_KEY_FILE_EXTENSION = ".key"
+const ED25519_KEY_FILE_EXTENSION = ".pub"
+
+const ALG_HS256 = "HS256"
+const ALG_EDDSA = "EdDSA"
+
+// JWT-style token header
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Token claims
+// Example: {"ns": ["org/event/*"], "role": "publisher", "exp": 1767225600, "tenant": "org"}
+type TokenClaims struct {
+	// Allowed namespaces (see MatchNamespace)
+	Namespaces []string `json:"ns"`
+	// publisher, subscriber or both
+	Role string `json:"role"`
+	// Expiration (unix time in seconds), mandatory
+	Exp int64 `json:"exp"`
+	// Not before (unix time in seconds), optional
+	Nbf int64 `json:"nbf,omitempty"`
+	// Tenant (used for quotas), optional
+	Tenant string `json:"tenant,omitempty"`
+}
+
+type signingKey struct {
+	alg     string
+	hmacKey []byte
+	edKey   ed25519.PublicKey
+}
+
+// Validates HS256 / EdDSA signed tokens with keys loaded from a directory,
+// the directory is reloaded periodically so keys can be rotated without restart
+type SignedTokenAuthorizer struct {
+	keysDir string
+	keys    map[string]signingKey
+
+	keysLock *sync.RWMutex
+
+	// Reload thread channel (only started with a reload period)
+	reloadChannel chan bool
+	reloading     bool
+}
+
+func NewSignedTokenFromDir(keysDir string, reloadPeriodMs uint64) (a *SignedTokenAuthorizer, err error) {
+	a = &SignedTokenAuthorizer{keysDir: keysDir, keys: map[string]signingKey{}, keysLock: new(sync.RWMutex), reloadChannel: make(chan bool)}
+
+	if err = a.reloadKeys(); err != nil {
+		return
+	}
+
+	if reloadPeriodMs > 0 {
+		a.reloading = true
+		go a.runReloadEvery(reloadPeriodMs, a.reloadChannel)
+	}
+
+	return
+}
+
+func (a *SignedTokenAuthorizer) Stop() {
+	if !a.reloading {
+		return
+	}
+	a.reloading = false
+
+	// Send finish signal
+	a.reloadChannel <- true
+
+	// Wait to finish
+	<-a.reloadChannel
+}
+
+func (a *SignedTokenAuthorizer) AuthorizeSetup(session SessionInfo) Result {
+	token := session.Token()
+	if token == "" {
+		return Deny(ReasonMissingCredentials, "Missing token")
+	}
+	claims, result := a.validate(token)
+	if !result.Allowed {
+		return result
+	}
+	result = claims.checkRole(session.Role)
+	result.Tenant = claims.Tenant
+	return result
+}
+
+func (a *SignedTokenAuthorizer) AuthorizeAnnounce(session SessionInfo, announce moqhelpers.MoqMessageAnnounce) Result {
+	return a.check(moqhelpers.MoqRolePublisher, session.MessageToken(announce.AuthInfo), announce.TrackNamespace)
+}
+
+func (a *SignedTokenAuthorizer) AuthorizeSubscribe(session SessionInfo, subscribe moqhelpers.MoqMessageSubscribe) Result {
+	return a.check(moqhelpers.MoqRoleSubscriber, session.MessageToken(subscribe.AuthInfo), subscribe.TrackNamespace)
+}
+
+func (a *SignedTokenAuthorizer) check(role moqhelpers.MoqRole, token string, trackNamespace string) Result {
+	if token == "" {
+		return Deny(ReasonMissingCredentials, "Missing token")
+	}
+	// Validated every time, so expired tokens stop working on live sessions
+	claims, result := a.validate(token)
+	if !result.Allowed {
+		return result
+	}
+	if result = claims.checkRole(role); !result.Allowed {
+		return result
+	}
+	for _, pattern := range claims.Namespaces {
+		if MatchNamespace(pattern, trackNamespace) {
+			return Allow()
+		}
+	}
+	return Deny(ReasonNamespaceForbidden, fmt.Sprintf("Namespace %s not allowed", trackNamespace))
+}
+
+func (a *SignedTokenAuthorizer) validate(token string) (claims TokenClaims, result Result) {
+	var (
+		header              tokenHeader
+		headerBuf, claimBuf []byte
+		sig                 []byte
+		err                 error
+	)
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, Deny(ReasonInvalidCredentials, "Malformed token")
+	}
+	if headerBuf, err = base64.RawURLEncoding.DecodeString(parts[0]); err != nil {
+		return claims, Deny(ReasonInvalidCredentials, "Malformed token header")
+	}
+	if claimBuf, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return claims, Deny(ReasonInvalidCredentials, "Malformed token claims")
+	}
+	if sig, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return claims, Deny(ReasonInvalidCredentials, "Malformed token signature")
+	}
+	if err = json.Unmarshal(headerBuf, &header); err != nil {
+		return claims, Deny(ReasonInvalidCredentials, "Malformed token header")
+	}
+
+	a.keysLock.RLock()
+	key, found := a.keys[header.Kid]
+	a.keysLock.RUnlock()
+	if !found {
+		return claims, Deny(ReasonInvalidCredentials, fmt.Sprintf("Unknown key id %s", header.Kid))
+	}
+	// The algorithm is defined by the key, never by the token
+	if header.Alg != key.alg {
+		return claims, Deny(ReasonInvalidCredentials, fmt.Sprintf("Invalid algorithm %s for key id %s", header.Alg, header.Kid))
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+	if key.alg == ALG_HS256 {
+		mac := hmac.New(sha256.New, key.hmacKey)
+		mac.Write(signingInput)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return claims, Deny(ReasonInvalidCredentials, "Invalid token signature")
+		}
+	} else if !ed25519.Verify(key.edKey, signingInput, sig) {
+		return claims, Deny(ReasonInvalidCredentials, "Invalid token signature")
+	}
+
+	if err = json.Unmarshal(claimBuf, &claims); err != nil {
+		return claims, Deny(ReasonInvalidCredentials, "Malformed token claims")
+	}
+	now := time.Now().Unix()
+	if claims.Exp <= 0 || now >= claims.Exp {
+		return claims, Deny(ReasonInvalidCredentials, "Token expired")
+	}
+	if claims.Nbf > 0 && now < claims.Nbf {
+		return claims, Deny(ReasonInvalidCredentials, "Token not valid yet")
+	}
+
+	return claims, Allow()
+}
+
+func (claims *TokenClaims) checkRole(role moqhelpers.MoqRole) Result {
+	if claims.Role == "both" ||
+		(claims.Role == "publisher" && role == moqhelpers.MoqRolePublisher) ||
+		(claims.Role == "subscriber" && role == moqhelpers.MoqRoleSubscriber) {
+		return Allow()
+	}
+	return Deny(ReasonRoleNotAllowed, fmt.Sprintf("Role not allowed by token (%s)", claims.Role))
+}
+
+// Keys housekeeping
+
+func (a *SignedTokenAuthorizer) runReloadEvery(periodMs uint64, reloadChannelBidi chan bool) {
+	timeCh := time.NewTicker(time.Millisecond * time.Duration(periodMs))
+	exit := false
+
+	for !exit {
+		select {
+		// Wait for the next tick
+		case <-timeCh.C:
+			if err := a.reloadKeys(); err != nil {
+				// Keep the previous keys
+				log.Error(fmt.Sprintf("Reloading token keys from %s. Err: %v", a.keysDir, err))
+			}
+
+		case <-reloadChannelBidi:
+			exit = true
+		}
+	}
+	timeCh.Stop()
+
+	// Indicates finished
+	reloadChannelBidi <- true
+}
+
+func (a *SignedTokenAuthorizer) reloadKeys() (err error) {
+	var (
+		entries []os.DirEntry
+		keys    map[string]signingKey = map[string]signingKey{}
+	)
+
+	if entries, err = os.ReadDir(a.keysDir); err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		var (
+			buf []byte
+			ext string = filepath.Ext(entry.Name())
+			kid string = strings.TrimSuffix(entry.Name(), ext)
+		)
+		if ext != HMAC_KEY_FILE_EXTENSION && ext != ED25519_KEY_FILE_EXTENSION {
+			continue
+		}
+		if _, found := keys[kid]; found {
+			// Ex: kid.key and kid.pub, tokens could NOT tell which one signed them
+			return errors.New(fmt.Sprintf("Key id %s defined twice", kid))
+		}
+		if buf, err = os.ReadFile(filepath.Join(a.keysDir, entry.Name())); err != nil {
+			return
+		}
+		if ext == HMAC_KEY_FILE_EXTENSION {
+			secret := []byte(strings.TrimSpace(string(buf)))
+			if len(secret) <= 0 {
+				return errors.New(fmt.Sprintf("Empty HMAC key %s", entry.Name()))
+			}
+			keys[kid] = signingKey{alg: ALG_HS256, hmacKey: secret}
+		} else {
+			var edKey ed25519.PublicKey
+			if edKey, err = parseEd25519PublicKey(buf); err != nil {
+				return errors.New(fmt.Sprintf("Parsing Ed25519 key %s, err: %v", entry.Name(), err))
+			}
+			keys[kid] = signingKey{alg: ALG_EDDSA, edKey: edKey}
+		}
+	}
+
+	a.keysLock.Lock()
+	changed := len(keys) != len(a.keys)
+	a.keys = keys
+	a.keysLock.Unlock()
+
+	if changed {
+		log.Info(fmt.Sprintf("Loaded %d token keys from %s", len(keys), a.keysDir))
+	}
+
+	return
+}
+
+func parseEd25519PublicKey(buf []byte) (edKey ed25519.PublicKey, err error) {
+	var (
+		pubKey any
+		ok     bool
+	)
+
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		err = errors.New("no PEM block found")
+		return
+	}
+	if pubKey, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return
+	}
+	if edKey, ok = pubKey.(ed25519.PublicKey); !ok {
+		err = errors.New("not an Ed25519 public key")
+	}
+	return
+}
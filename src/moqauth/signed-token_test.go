@@ -0,0 +1,186 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqauth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testHmacSecret = "test-secret"
+
+func encodePart(t *testing.T, v any) string {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func signHS256(t *testing.T, alg string, kid string, claims TokenClaims, secret []byte) string {
+	signingInput := encodePart(t, tokenHeader{Alg: alg, Kid: kid}) + "." + encodePart(t, claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signEdDSA(t *testing.T, kid string, claims TokenClaims, privKey ed25519.PrivateKey) string {
+	signingInput := encodePart(t, tokenHeader{Alg: ALG_EDDSA, Kid: kid}) + "." + encodePart(t, claims)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(privKey, []byte(signingInput)))
+}
+
+// Keys dir with hmac.key and ed.pub, returns the Ed25519 private key and the PEM of the public one
+func writeTestKeys(t *testing.T) (dir string, privKey ed25519.PrivateKey, pubPem []byte) {
+	dir = t.TempDir()
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPem = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err = os.WriteFile(filepath.Join(dir, "hmac"+HMAC_KEY_FILE_EXTENSION), []byte(testHmacSecret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "ed"+ED25519_KEY_FILE_EXTENSION), pubPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestSignedTokenValidate(t *testing.T) {
+	dir, privKey, pubPem := writeTestKeys(t)
+	a, err := NewSignedTokenFromDir(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+
+	now := time.Now().Unix()
+	valid := TokenClaims{Namespaces: []string{"org/*"}, Role: "both", Exp: now + 60}
+	expired := valid
+	expired.Exp = now - 1
+	noExp := valid
+	noExp.Exp = 0
+	notYet := valid
+	notYet.Nbf = now + 60
+	publisher := valid
+	publisher.Role = "publisher"
+
+	tests := []struct {
+		name      string
+		token     string
+		role      moqhelpers.MoqRole
+		namespace string
+		want      Reason
+	}{
+		{name: "HS256", token: signHS256(t, ALG_HS256, "hmac", valid, []byte(testHmacSecret)), want: ReasonAllowed},
+		{name: "EdDSA", token: signEdDSA(t, "ed", valid, privKey), want: ReasonAllowed},
+		{name: "expired", token: signHS256(t, ALG_HS256, "hmac", expired, []byte(testHmacSecret)), want: ReasonInvalidCredentials},
+		{name: "without expiration", token: signHS256(t, ALG_HS256, "hmac", noExp, []byte(testHmacSecret)), want: ReasonInvalidCredentials},
+		{name: "NOT valid yet", token: signEdDSA(t, "ed", notYet, privKey), want: ReasonInvalidCredentials},
+		{name: "wrong secret", token: signHS256(t, ALG_HS256, "hmac", valid, []byte("other")), want: ReasonInvalidCredentials},
+		// HMAC with the public key as secret, the algorithm is defined by the key
+		{name: "HS256 with an Ed25519 key id", token: signHS256(t, ALG_HS256, "ed", valid, pubPem), want: ReasonInvalidCredentials},
+		{name: "EdDSA with an HMAC key id", token: signEdDSA(t, "hmac", valid, privKey), want: ReasonInvalidCredentials},
+		{name: "unknown key id", token: signHS256(t, ALG_HS256, "other", valid, []byte(testHmacSecret)), want: ReasonInvalidCredentials},
+		{name: "malformed", token: "abc.def", want: ReasonInvalidCredentials},
+		{name: "namespace NOT allowed", token: signEdDSA(t, "ed", valid, privKey), namespace: "other/live", want: ReasonNamespaceForbidden},
+		{name: "role NOT allowed", token: signEdDSA(t, "ed", publisher, privKey), role: moqhelpers.MoqRoleSubscriber, want: ReasonRoleNotAllowed},
+		{name: "missing", token: "", want: ReasonMissingCredentials},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			role, namespace := test.role, test.namespace
+			if role == 0 {
+				role = moqhelpers.MoqRolePublisher
+			}
+			if namespace == "" {
+				namespace = "org/live"
+			}
+			if result := a.check(role, test.token, namespace); result.Reason != test.want {
+				t.Fatalf("got %d (%s), want %d", result.Reason, result.Msg, test.want)
+			}
+		})
+	}
+}
+
+func TestSignedTokenKidDefinedTwice(t *testing.T) {
+	dir, _, _ := writeTestKeys(t)
+	if err := os.WriteFile(filepath.Join(dir, "ed"+HMAC_KEY_FILE_EXTENSION), []byte(testHmacSecret), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSignedTokenFromDir(dir, 0); err == nil {
+		t.Fatal("expected error, ed.key and ed.pub define the same key id")
+	}
+}
+
+func TestSignedTokenReload(t *testing.T) {
+	dir, privKey, _ := writeTestKeys(t)
+	a, err := NewSignedTokenFromDir(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := TokenClaims{Namespaces: []string{"*"}, Role: "both", Exp: time.Now().Unix() + 60}
+
+	// Removed keys stop working after the next reload
+	if err = os.Remove(filepath.Join(dir, "ed"+ED25519_KEY_FILE_EXTENSION)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for a.check(moqhelpers.MoqRolePublisher, signEdDSA(t, "ed", claims, privKey), "org").Allowed {
+		if time.Now().After(deadline) {
+			t.Fatal("removed key still valid")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stopped := make(chan bool)
+	go func() {
+		a.Stop()
+		a.Stop()
+		stopped <- true
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked")
+	}
+}
+
+func TestSignedTokenStopWithoutReload(t *testing.T) {
+	dir, _, _ := writeTestKeys(t)
+	a, err := NewSignedTokenFromDir(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan bool)
+	go func() {
+		a.Stop()
+		stopped <- true
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked without a reload thread")
+	}
+}
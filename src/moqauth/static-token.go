@@ -0,0 +1,56 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqauth
+
+import (
+	"crypto/subtle"
+	"facebookexperimental/moq-go-server/moqhelpers"
+)
+
+// Shared token per role, an empty token leaves that role open
+type StaticTokenAuthorizer struct {
+	publishToken   string
+	subscribeToken string
+}
+
+func NewStaticToken(publishToken string, subscribeToken string) *StaticTokenAuthorizer {
+	return &StaticTokenAuthorizer{publishToken: publishToken, subscribeToken: subscribeToken}
+}
+
+func (a *StaticTokenAuthorizer) AuthorizeSetup(session SessionInfo) Result {
+	// Token can also be sent later on ANNOUNCE / SUBSCRIBE, only a wrong one is rejected here
+	token := session.Token()
+	if token == "" {
+		return Allow()
+	}
+	return a.check(session.Role, token)
+}
+
+func (a *StaticTokenAuthorizer) AuthorizeAnnounce(session SessionInfo, announce moqhelpers.MoqMessageAnnounce) Result {
+	return a.check(moqhelpers.MoqRolePublisher, session.MessageToken(announce.AuthInfo))
+}
+
+func (a *StaticTokenAuthorizer) AuthorizeSubscribe(session SessionInfo, subscribe moqhelpers.MoqMessageSubscribe) Result {
+	return a.check(moqhelpers.MoqRoleSubscriber, session.MessageToken(subscribe.AuthInfo))
+}
+
+func (a *StaticTokenAuthorizer) check(role moqhelpers.MoqRole, token string) Result {
+	expected := a.subscribeToken
+	if role == moqhelpers.MoqRolePublisher {
+		expected = a.publishToken
+	}
+	if expected == "" {
+		return Allow()
+	}
+	if token == "" {
+		return Deny(ReasonMissingCredentials, "Missing token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return Deny(ReasonInvalidCredentials, "Invalid token")
+	}
+	return Allow()
+}
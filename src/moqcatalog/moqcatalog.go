@@ -0,0 +1,244 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqcatalog
+
+import (
+	"encoding/json"
+	"facebookexperimental/moq-go-server/moqfwdtable"
+	"facebookexperimental/moq-go-server/moqmessageobjects"
+	"facebookexperimental/moq-go-server/moqobject"
+	"facebookexperimental/moq-go-server/moqtrackpolicy"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Track of every namespace answered by the relay, the leading dot avoids clashes with published tracks
+const CATALOG_TRACK_NAME = ".catalog"
+const CATALOG_VERSION = 1
+
+// Packaging of the track payload
+const (
+	PACKAGING_LOC    = "loc"
+	PACKAGING_OPAQUE = "opaque"
+)
+
+// Rendition of a track, subscribing to Name gets only that bitrate
+type Rendition struct {
+	Name       string `json:"name"`
+	Bitrate    uint64 `json:"bitrate"`
+	Resolution string `json:"resolution,omitempty"`
+	// Rendition that holds the payload as received from the publisher
+	Source bool `json:"source,omitempty"`
+}
+
+// Track published in the namespace, subscribing to Name gets a rendition chosen by the relay (ETP)
+type Track struct {
+	Name string `json:"name"`
+	// From the LOC header (empty for opaque tracks)
+	MediaType  string      `json:"media_type,omitempty"`
+	Packaging  string      `json:"packaging"`
+	Renditions []Rendition `json:"renditions,omitempty"`
+}
+
+// Catalog track payload (JSON), every new version is a new group
+type Catalog struct {
+	Version   int     `json:"version"`
+	Namespace string  `json:"namespace"`
+	Tracks    []Track `json:"tracks"`
+}
+
+type namespaceCatalog struct {
+	tracks map[string]Track
+	// Session that publishes every track
+	publishers map[string]string
+	// Latest version
+	cacheKey  moqobject.CacheKey
+	nextGroup uint64
+}
+
+// Generates the catalog track of every namespace from the tracks seen at ingest
+type MoqCatalog struct {
+	objects     *moqmessageobjects.MoqMessageObjects
+	fwdTable    *moqfwdtable.MoqFwdTable
+	trackPolicy *moqtrackpolicy.MoqTrackPolicy
+	objExpS     uint64
+
+	namespaces map[string]*namespaceCatalog
+
+	lock *sync.RWMutex
+}
+
+func New(objects *moqmessageobjects.MoqMessageObjects, fwdTable *moqfwdtable.MoqFwdTable, trackPolicy *moqtrackpolicy.MoqTrackPolicy, objExpMs uint64) *MoqCatalog {
+	return &MoqCatalog{objects: objects, fwdTable: fwdTable, trackPolicy: trackPolicy, objExpS: objExpMs / 1000, namespaces: map[string]*namespaceCatalog{}, lock: new(sync.RWMutex)}
+}
+
+func IsCatalogTrack(trackName string) bool {
+	return trackName == CATALOG_TRACK_NAME
+}
+
+// Adds the track received from publisher (session name) to the catalog of its namespace (mediaType empty
+// for opaque tracks), a new version is published only if the track is new or its media type changed
+func (c *MoqCatalog) TrackSeen(publisher string, trackKey moqobject.TrackKey, mode moqtrackpolicy.Mode, mediaType string) {
+	if IsCatalogTrack(trackKey.Name) {
+		// Published by the relay
+		return
+	}
+	c.lock.RLock()
+	nsCatalog, found := c.namespaces[trackKey.Namespace]
+	if found {
+		var track Track
+		if track, found = nsCatalog.tracks[trackKey.Name]; found && track.MediaType == mediaType && nsCatalog.publishers[trackKey.Name] == publisher {
+			c.lock.RUnlock()
+			return
+		}
+	}
+	c.lock.RUnlock()
+
+	c.lock.Lock()
+	nsCatalog = c.namespaceLocked(trackKey.Namespace)
+	nsCatalog.publishers[trackKey.Name] = publisher
+	track, found := nsCatalog.tracks[trackKey.Name]
+	if found && track.MediaType == mediaType {
+		// Only a new publisher
+		c.lock.Unlock()
+		return
+	}
+	nsCatalog.tracks[trackKey.Name] = c.newTrack(trackKey, mode, mediaType)
+	cacheKey, err := c.publishLocked(trackKey.Namespace, nsCatalog)
+	c.lock.Unlock()
+
+	if err != nil {
+		log.Error(fmt.Sprintf("Publishing catalog of %s. Err: %v", trackKey.Namespace, err))
+		return
+	}
+	c.fwdTable.ReceivedObject(cacheKey)
+}
+
+// Removes the tracks of the publisher (session name) when it goes away, and publishes a new version of
+// every namespace it changed. Namespaces left without tracks get an empty version and are deleted
+func (c *MoqCatalog) PublisherGone(publisher string) {
+	var (
+		cacheKeys []moqobject.CacheKey
+	)
+
+	c.lock.Lock()
+	for trackNamespace, nsCatalog := range c.namespaces {
+		removed := 0
+		for trackName, trackPublisher := range nsCatalog.publishers {
+			if trackPublisher == publisher {
+				delete(nsCatalog.tracks, trackName)
+				delete(nsCatalog.publishers, trackName)
+				removed++
+			}
+		}
+		if removed <= 0 {
+			continue
+		}
+		cacheKey, err := c.publishLocked(trackNamespace, nsCatalog)
+		if err != nil {
+			log.Error(fmt.Sprintf("Publishing catalog of %s. Err: %v", trackNamespace, err))
+		} else {
+			cacheKeys = append(cacheKeys, cacheKey)
+		}
+		if len(nsCatalog.tracks) <= 0 {
+			delete(c.namespaces, trackNamespace)
+		}
+	}
+	c.lock.Unlock()
+
+	for _, cacheKey := range cacheKeys {
+		c.fwdTable.ReceivedObject(cacheKey)
+	}
+}
+
+func (c *MoqCatalog) newTrack(trackKey moqobject.TrackKey, mode moqtrackpolicy.Mode, mediaType string) Track {
+	track := Track{Name: trackKey.Name, MediaType: mediaType, Packaging: PACKAGING_LOC}
+	if mode == moqtrackpolicy.ModeOpaque {
+		track.Packaging = PACKAGING_OPAQUE
+	}
+	ladder := c.trackPolicy.LadderFor(mode, trackKey.Namespace, trackKey.Name)
+	if len(ladder) <= 1 {
+		// Nothing to choose from
+		return track
+	}
+	for _, quality := range ladder {
+		track.Renditions = append(track.Renditions, Rendition{Name: moqobject.RenditionTrackName(trackKey.Name, quality.Bitrate), Bitrate: quality.Bitrate, Resolution: quality.Resolution, Source: quality.Passthrough})
+	}
+	return track
+}
+
+// Latest catalog of the namespace, published again if it is NOT in the cache anymore (expired). Only
+// namespaces with tracks seen are found, so subscribers can NOT create catalogs
+func (c *MoqCatalog) Latest(trackNamespace string) (cacheKey moqobject.CacheKey, found bool, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	nsCatalog, found := c.namespaces[trackNamespace]
+	if !found {
+		return
+	}
+	latestGroup, foundGroup := c.objects.LatestGroup(nsCatalog.cacheKey.TrackKey)
+	if foundGroup && latestGroup == nsCatalog.cacheKey.Group {
+		return nsCatalog.cacheKey, true, nil
+	}
+	cacheKey, err = c.publishLocked(trackNamespace, nsCatalog)
+	return
+}
+
+func (c *MoqCatalog) namespaceLocked(trackNamespace string) *namespaceCatalog {
+	nsCatalog, found := c.namespaces[trackNamespace]
+	if !found {
+		nsCatalog = &namespaceCatalog{tracks: map[string]Track{}, publishers: map[string]string{}}
+		// Versions of a deleted namespace can still be in the cache
+		if latestGroup, foundGroup := c.objects.LatestGroup(moqobject.NewTrackKey(trackNamespace, CATALOG_TRACK_NAME)); foundGroup {
+			nsCatalog.nextGroup = latestGroup + 1
+		}
+		c.namespaces[trackNamespace] = nsCatalog
+	}
+	return nsCatalog
+}
+
+// Stores a new version of the catalog in the cache
+func (c *MoqCatalog) publishLocked(trackNamespace string, nsCatalog *namespaceCatalog) (cacheKey moqobject.CacheKey, err error) {
+	var (
+		buf []byte
+	)
+
+	catalog := Catalog{Version: CATALOG_VERSION, Namespace: trackNamespace, Tracks: []Track{}}
+	for _, track := range nsCatalog.tracks {
+		catalog.Tracks = append(catalog.Tracks, track)
+	}
+	slices.SortFunc(catalog.Tracks, func(a Track, b Track) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	if buf, err = json.Marshal(catalog); err != nil {
+		return
+	}
+
+	// Groups based on time, so they keep increasing after a restart (cache snapshot)
+	group := max(uint64(time.Now().UnixMilli()), nsCatalog.nextGroup)
+	objHeader := moqobject.MoqObjectHeader{GroupSequence: group}
+	cacheKey = moqobject.NewCacheKey(moqobject.NewTrackKey(trackNamespace, CATALOG_TRACK_NAME), objHeader)
+
+	moqObjs, err := c.objects.Create(cacheKey, objHeader, c.objExpS, []uint64{moqmessageobjects.OPAQUE_BITRATE})
+	if err != nil {
+		return
+	}
+	moqObjs[moqmessageobjects.OPAQUE_BITRATE].PayloadWrite(buf)
+	moqObjs[moqmessageobjects.OPAQUE_BITRATE].SetEof()
+	nsCatalog.cacheKey = cacheKey
+	nsCatalog.nextGroup = group + 1
+
+	log.Info(fmt.Sprintf("Published catalog %s, tracks: %d", cacheKey, len(catalog.Tracks)))
+
+	return
+}
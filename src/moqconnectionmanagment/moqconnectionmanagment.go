@@ -7,15 +7,23 @@ LICENSE file in the root directory of this source tree.
 package moqconnectionmanagment
 
 import (
+	"encoding/json"
 	"errors"
 	"facebookexperimental/moq-go-server/awt"
+	"facebookexperimental/moq-go-server/moqabr"
+	"facebookexperimental/moq-go-server/moqauth"
+	"facebookexperimental/moq-go-server/moqcatalog"
+	"facebookexperimental/moq-go-server/moqdvr"
 	"facebookexperimental/moq-go-server/moqfwdtable"
 	"facebookexperimental/moq-go-server/moqhelpers"
 	"facebookexperimental/moq-go-server/moqmessageobjects"
 	"facebookexperimental/moq-go-server/moqobject"
+	"facebookexperimental/moq-go-server/moqquota"
 	"facebookexperimental/moq-go-server/moqsession"
+	"facebookexperimental/moq-go-server/moqtrackpolicy"
 	"fmt"
-	"strconv"
+	"net/url"
+	"time"
 
 	"github.com/quic-go/webtransport-go"
 
@@ -23,7 +31,7 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func MoqConnectionManagment(session *webtransport.Session, namespace string, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, objExpMs uint64, qlog string) {
+func MoqConnectionManagment(session *webtransport.Session, namespace string, query url.Values, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, objExpMs uint64, connStats *awt.ConnectionStats, authorizer moqauth.Authorizer, quotas *moqquota.MoqQuotas, trackPolicy *moqtrackpolicy.MoqTrackPolicy, recorder *moqdvr.Recorder, catalog *moqcatalog.MoqCatalog, abr moqabr.ABRPolicy, statsIntervalMs uint64, shapers *awt.ShaperRegistry, catchUpGroups uint64, cacheOnlyExpiresMs uint64) {
 
 	// Accept bidirectional streams (control stream)
 	stream, err := session.AcceptStream(session.Context())
@@ -61,7 +69,26 @@ func MoqConnectionManagment(session *webtransport.Session, namespace string, moq
 		return
 	}
 
-	moqSession := moqsession.New(namespace+"/"+uuid.New().String(), moqSetupResponse.Version, moqSetup.Role, qlog)
+	authSession := moqauth.SessionInfo{Path: namespace, Query: query, Role: moqSetup.Role, AuthInfo: moqSetup.AuthInfo}
+	authResult := authorizer.AuthorizeSetup(authSession)
+	if !authResult.Allowed {
+		log.Error(fmt.Sprintf("%s - Unauthorized SETUP. Reason: %d, msg: %s", namespace, authResult.Reason, authResult.Msg))
+		terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: authResult.SessionErrorCode(), ErrMsg: "Unauthorized"})
+		return
+	}
+
+	tenant := quotas.Resolve(authSession, authResult.Tenant)
+	errQuota := tenant.AcquireSession(moqSetup.Role)
+	if errQuota != nil {
+		log.Error(fmt.Sprintf("%s - Quota exceeded on SETUP. Err: %v", namespace, errQuota))
+		terminateSessionWithError(session, moqhelpers.MoqError{ErrCode: moqhelpers.ErrorQuotaExceeded, ErrMsg: "Max sessions reached"})
+		return
+	}
+	defer tenant.ReleaseSession(moqSetup.Role)
+
+	moqSession := moqsession.New(namespace+"/"+uuid.New().String(), moqSetupResponse.Version, moqSetup.Role, connStats)
+	moqSession.SetLimits(tenant.MaxNamespacesPerSession, tenant.MaxTracksPerSession)
+	moqSession.SetABRPolicy(abr)
 	errAddSession := moqtFwdTable.AddSession(moqSession)
 	if errAddSession != nil {
 		log.Error(fmt.Sprintf("%s - Error adding session %s. Err: %v", moqSession.UniqueName, moqSession.UniqueName, errAddSession))
@@ -71,12 +98,19 @@ func MoqConnectionManagment(session *webtransport.Session, namespace string, moq
 
 	if moqSetup.Role == moqhelpers.MoqRolePublisher {
 		// They will exit when session finishes
-		go startListeningObjects(session, moqSession, moqtFwdTable, objects, objExpMs)
+		go startListeningObjects(session, moqSession, moqtFwdTable, objects, objExpMs, trackPolicy, recorder, catalog, tenant)
 		go startForwardSubscribes(stream, moqSession)
 	} else if moqSetup.Role == moqhelpers.MoqRoleSubscriber {
+		// Userspace bandwidth shaping of this session (no limit until set over HTTP)
+		shaper := shapers.Add(moqSession.UniqueName)
+		defer shapers.Remove(moqSession.UniqueName)
+
 		// It will exit when session finishes
-		go startForwardingObjects(session, moqSession, objects)
+		go startForwardingObjects(session, moqSession, objects, trackPolicy, tenant, shaper)
 		go startForwardSubscribeResponses(stream, moqSession)
+		if statsIntervalMs > 0 {
+			go startReportingStats(session, moqSession, statsIntervalMs)
+		}
 	}
 
 	errorSessionMoq := moqhelpers.MoqError{}
@@ -100,12 +134,17 @@ func MoqConnectionManagment(session *webtransport.Session, namespace string, moq
 				break
 			}
 			if moqMsgType == moqhelpers.MoqIdMessageAnnounce {
-				errorSessionMoq = processAnnounce(moqMsg, stream, moqSession)
+				errorSessionMoq = processAnnounce(moqMsg, stream, moqSession, authorizer, authSession)
 				if errorSessionMoq.ErrCode != moqhelpers.NoError {
 					break
 				}
 			} else if moqMsgType == moqhelpers.MoqIdSubscribe {
-				errorSessionMoq = processSubscribe(moqMsg, stream, moqSession, moqtFwdTable)
+				errorSessionMoq = processSubscribe(moqMsg, stream, moqSession, moqtFwdTable, objects, catchUpGroups, cacheOnlyExpiresMs, authorizer, authSession, tenant, trackPolicy, catalog)
+				if errorSessionMoq.ErrCode != moqhelpers.NoError {
+					break
+				}
+			} else if moqMsgType == moqhelpers.MoqIdUnsubscribe {
+				errorSessionMoq = processUnsubscribe(moqMsg, moqSession)
 				if errorSessionMoq.ErrCode != moqhelpers.NoError {
 					break
 				}
@@ -130,6 +169,9 @@ func MoqConnectionManagment(session *webtransport.Session, namespace string, moq
 	if errRemoveSession != nil {
 		log.Error(fmt.Sprintf("%s - Error removing session %s", moqSession.UniqueName, moqSession.UniqueName))
 	}
+	if moqSession.Role != moqhelpers.MoqRoleSubscriber {
+		catalog.PublisherGone(moqSession.UniqueName)
+	}
 
 	if errorSessionMoq.ErrCode != moqhelpers.NoError {
 		terminateSessionWithError(session, errorSessionMoq)
@@ -140,11 +182,11 @@ func terminateSessionWithError(session *webtransport.Session, errMoq moqhelpers.
 	session.CloseWithError(webtransport.SessionErrorCode(errMoq.ErrCode), errMoq.ErrMsg)
 }
 
-func createObjectCacheKey(trackNamespace string, trackName string, moqObjectHeader moqobject.MoqObjectHeader) string {
-	return trackNamespace + "/" + trackName + "/" + strconv.FormatUint(moqObjectHeader.GroupSequence, 10) + "/" + strconv.FormatUint(moqObjectHeader.ObjectSequence, 10)
+func createObjectCacheKey(trackNamespace string, trackName string, moqObjectHeader moqobject.MoqObjectHeader) moqobject.CacheKey {
+	return moqobject.NewCacheKey(moqobject.NewTrackKey(trackNamespace, trackName), moqObjectHeader)
 }
 
-func processAnnounce(moqMsg interface{}, stream webtransport.Stream, moqSession *moqsession.MoqSession) (errorSessionMoq moqhelpers.MoqError) {
+func processAnnounce(moqMsg interface{}, stream webtransport.Stream, moqSession *moqsession.MoqSession, authorizer moqauth.Authorizer, authSession moqauth.SessionInfo) (errorSessionMoq moqhelpers.MoqError) {
 	moqAnnounceError := moqhelpers.MoqMessageAnnounceError{}
 
 	moqAnnounce, moqAnnounceConv := moqMsg.(moqhelpers.MoqMessageAnnounce)
@@ -167,38 +209,47 @@ func processAnnounce(moqMsg interface{}, stream webtransport.Stream, moqSession
 	}
 
 	if errorSessionMoq.ErrCode == moqhelpers.NoError {
+		authResult := authorizer.AuthorizeAnnounce(authSession, moqAnnounce)
+		if !authResult.Allowed {
+			// Announce error
+			moqAnnounceError = moqhelpers.MoqMessageAnnounceError{TrackNamespace: moqAnnounce.TrackNamespace, ErrCode: authResult.AnnounceErrorCode(), ErrMsg: authResult.Msg}
+			log.Error(fmt.Sprintf("%s - Unauthorized ANNOUNCE for %s. Reason: %d, msg: %s", moqSession.UniqueName, moqAnnounce.TrackNamespace, authResult.Reason, authResult.Msg))
+		}
+	}
+
+	if errorSessionMoq.ErrCode == moqhelpers.NoError && moqAnnounceError.ErrCode == moqhelpers.NoErrorAnnounce {
 		errAddAnnounceTrack := moqSession.AddTrackNamespace(moqAnnounce)
 		if errAddAnnounceTrack != nil {
 			// Announce error
-			moqAnnounceError = moqhelpers.MoqMessageAnnounceError{ErrCode: moqhelpers.ErrorAnnounceAddingTrack, ErrMsg: "Error Adding new track on ANNOUNCE"}
+			moqAnnounceError = moqhelpers.MoqMessageAnnounceError{TrackNamespace: moqAnnounce.TrackNamespace, ErrCode: moqhelpers.ErrorAnnounceQuotaExceeded, ErrMsg: "Max namespaces per session reached"}
 			log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, moqAnnounceError.ErrMsg, errAddAnnounceTrack))
 		}
+	}
 
-		if errorSessionMoq.ErrCode == moqhelpers.NoError {
-			// Session NOT broken
-			if moqAnnounceError.ErrCode == moqhelpers.NoErrorAnnounce {
-				// Send announce OK
-				moqAnnounceOk := moqhelpers.CreateAnnounceOK(moqAnnounce)
-				errMoqTxAnnounceOk := moqhelpers.SendAnnounceOK(stream, moqAnnounceOk)
-				if errMoqTxAnnounceOk != nil {
-					// Break session
-					errorSessionMoq.ErrCode = moqhelpers.ErrorGeneric
-					errorSessionMoq.ErrMsg = "Error sending ANNOUNCE OK"
-					log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, errorSessionMoq.ErrMsg, errMoqTxAnnounceOk))
-				} else {
-					log.Info(fmt.Sprintf("%s - Sent ANNOUNCE OK message %v", moqSession.UniqueName, moqAnnounceOk))
-				}
+	if errorSessionMoq.ErrCode == moqhelpers.NoError {
+		// Session NOT broken
+		if moqAnnounceError.ErrCode == moqhelpers.NoErrorAnnounce {
+			// Send announce OK
+			moqAnnounceOk := moqhelpers.CreateAnnounceOK(moqAnnounce)
+			errMoqTxAnnounceOk := moqhelpers.SendAnnounceOK(stream, moqAnnounceOk)
+			if errMoqTxAnnounceOk != nil {
+				// Break session
+				errorSessionMoq.ErrCode = moqhelpers.ErrorGeneric
+				errorSessionMoq.ErrMsg = "Error sending ANNOUNCE OK"
+				log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, errorSessionMoq.ErrMsg, errMoqTxAnnounceOk))
 			} else {
-				// Send announce Error
-				errMoqTxAnnounceError := moqhelpers.SendAnnounceError(stream, moqAnnounceError)
-				if errMoqTxAnnounceError != nil {
-					// Break session
-					errorSessionMoq.ErrCode = moqhelpers.ErrorGeneric
-					errorSessionMoq.ErrMsg = "Error sending ANNOUNCE error"
-					log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, errorSessionMoq.ErrMsg, errMoqTxAnnounceError))
-				} else {
-					log.Info(fmt.Sprintf("%s - Sent ANNOUNCE error message %v", moqSession.UniqueName, moqAnnounceError))
-				}
+				log.Info(fmt.Sprintf("%s - Sent ANNOUNCE OK message %v", moqSession.UniqueName, moqAnnounceOk))
+			}
+		} else {
+			// Send announce Error
+			errMoqTxAnnounceError := moqhelpers.SendAnnounceError(stream, moqAnnounceError)
+			if errMoqTxAnnounceError != nil {
+				// Break session
+				errorSessionMoq.ErrCode = moqhelpers.ErrorGeneric
+				errorSessionMoq.ErrMsg = "Error sending ANNOUNCE error"
+				log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, errorSessionMoq.ErrMsg, errMoqTxAnnounceError))
+			} else {
+				log.Info(fmt.Sprintf("%s - Sent ANNOUNCE error message %v", moqSession.UniqueName, moqAnnounceError))
 			}
 		}
 	}
@@ -206,8 +257,11 @@ func processAnnounce(moqMsg interface{}, stream webtransport.Stream, moqSession
 	return
 }
 
-func processSubscribe(moqMsg interface{}, stream webtransport.Stream, moqSession *moqsession.MoqSession, moqtFwdTable *moqfwdtable.MoqFwdTable) (errorSessionMoq moqhelpers.MoqError) {
+func processSubscribe(moqMsg interface{}, stream webtransport.Stream, moqSession *moqsession.MoqSession, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, catchUpGroups uint64, cacheOnlyExpiresMs uint64, authorizer moqauth.Authorizer, authSession moqauth.SessionInfo, tenant *moqquota.Tenant, trackPolicy *moqtrackpolicy.MoqTrackPolicy, catalog *moqcatalog.MoqCatalog) (errorSessionMoq moqhelpers.MoqError) {
 	moqSubscribeError := moqhelpers.MoqMessageSubscribeError{}
+	source := moqsession.SubscriptionSource{}
+	numCaughtUp := 0
+	subscriptionAdded := false
 
 	moqSubscribe, moqSubscribeConv := moqMsg.(moqhelpers.MoqMessageSubscribe)
 	if !moqSubscribeConv {
@@ -230,25 +284,82 @@ func processSubscribe(moqMsg interface{}, stream webtransport.Stream, moqSession
 	}
 
 	if errorSessionMoq.ErrCode == moqhelpers.NoError {
-		errAddingSubscribeReq := moqSession.AddSubscribeRequest(moqSubscribe)
-		if errAddingSubscribeReq != nil {
-			moqSubscribeError = moqhelpers.MoqMessageSubscribeError{ErrCode: moqhelpers.ErrorSubscribeAddingTrack, ErrMsg: "Error Adding new subscription on SUBSCRIBE"}
-			log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, moqSubscribeError.ErrMsg, errAddingSubscribeReq))
+		authResult := authorizer.AuthorizeSubscribe(authSession, moqSubscribe)
+		if !authResult.Allowed {
+			moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: authResult.SubscribeErrorCode(), ErrMsg: authResult.Msg}
+			log.Error(fmt.Sprintf("%s - Unauthorized SUBSCRIBE for %s/%s. Reason: %d, msg: %s", moqSession.UniqueName, moqSubscribe.TrackNamespace, moqSubscribe.TrackName, authResult.Reason, authResult.Msg))
+		} else if !tenant.EgressAllowed() {
+			moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeQuotaExceeded, ErrMsg: "Egress bitrate quota exceeded"}
+			log.Error(fmt.Sprintf("%s - %s, tenant: %s", moqSession.UniqueName, moqSubscribeError.ErrMsg, tenant.Name))
+		}
+	}
+
+	if errorSessionMoq.ErrCode == moqhelpers.NoError && moqSubscribeError.ErrCode == moqhelpers.NoErrorSubscribe {
+		// Rendition tracks get the objects of their base track (subscribed upstream), with a fixed bitrate
+		source.TrackKey = moqobject.NewTrackKey(moqSubscribe.TrackNamespace, moqSubscribe.TrackName)
+		if baseName, bitrate, isRendition := trackPolicy.RenditionFor(moqSubscribe.TrackNamespace, moqSubscribe.TrackName); isRendition {
+			source = moqsession.SubscriptionSource{TrackKey: moqobject.NewTrackKey(moqSubscribe.TrackNamespace, baseName), Bitrate: bitrate, FixedBitrate: true}
+		}
+		// New subscriptions first get the latest groups held in the cache (NOT relay tracks, they are answered apart)
+		var recent func(source moqobject.TrackKey) []moqobject.CacheKey
+		if catchUpGroups > 0 && !moqcatalog.IsCatalogTrack(moqSubscribe.TrackName) && !moqsession.IsStatsTrack(moqSubscribe.TrackName) {
+			recent = func(source moqobject.TrackKey) []moqobject.CacheKey {
+				return objects.RecentGroups(source, catchUpGroups)
+			}
+		}
+		var errAbr error
+		if moqSubscribe.AbrPolicy != "" {
+			source.ABR, errAbr = moqabr.New(moqSubscribe.AbrPolicy)
+		}
+		if errAbr != nil {
+			moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeGeneric, ErrMsg: "Invalid ABR policy"}
+			log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, moqSubscribeError.ErrMsg, errAbr))
+		} else {
+			var errAddingSubscribeReq error
+			if numCaughtUp, errAddingSubscribeReq = moqSession.AddSubscribeRequest(moqSubscribe, source, recent); errAddingSubscribeReq != nil {
+				moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeQuotaExceeded, ErrMsg: "Max tracks per session reached"}
+				log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, moqSubscribeError.ErrMsg, errAddingSubscribeReq))
+			} else {
+				subscriptionAdded = true
+			}
 		}
 	}
 
 	if errorSessionMoq.ErrCode == moqhelpers.NoError {
 		// Session NOT broken
-		if moqSubscribeError.ErrCode == moqhelpers.NoErrorSubscribe {
+		if moqSubscribeError.ErrCode == moqhelpers.NoErrorSubscribe && moqcatalog.IsCatalogTrack(moqSubscribe.TrackName) {
+			// The relay is the publisher of the catalog
+			moqSubscribeError, errorSessionMoq = answerCatalogSubscribe(moqSubscribe, moqSession, catalog)
+		} else if moqSubscribeError.ErrCode == moqhelpers.NoErrorSubscribe && moqsession.IsStatsTrack(moqSubscribe.TrackName) {
+			// The relay is the publisher of the stats, reports are sent by the stats thread
+			for _, moqSubscribeOk := range moqSession.ValidatePendingTrackSubscriptions(source.TrackKey, 0) {
+				moqSession.ForwardSubscribeResponseOk(moqSubscribeOk)
+			}
+		} else if moqSubscribeError.ErrCode == moqhelpers.NoErrorSubscribe {
 			// Forward every subscribe to publishers of that stream
-			errForwardSubscribe := moqtFwdTable.ForwardSubscribe(moqSubscribe)
-			if errForwardSubscribe != nil {
-				moqSubscribeError = moqhelpers.MoqMessageSubscribeError{ErrCode: moqhelpers.ErrorSubscribeNoPublishers, ErrMsg: errForwardSubscribe.Error()}
+			moqSubscribeUpstream := moqSubscribe
+			moqSubscribeUpstream.TrackName = source.Name
+			errForwardSubscribe := moqtFwdTable.ForwardSubscribe(moqSubscribeUpstream)
+			_, foundCached := objects.LatestGroup(source.TrackKey)
+			if errForwardSubscribe != nil && foundCached {
+				// No publisher yet (ex: relay restarted with a cache snapshot), the relay answers with what it holds
+				// (at least the latest group) for a while, the subscriber renews when it expires
+				numCaughtUp += moqSession.CatchUpTrackSubscription(moqobject.NewTrackKey(moqSubscribe.TrackNamespace, moqSubscribe.TrackName), objects.RecentGroups(source.TrackKey, 1))
+				log.Warning(fmt.Sprintf("%s - Answering SUBSCRIBE for %s/%s from the cache, objects: %d. Err: %v", moqSession.UniqueName, moqSubscribe.TrackNamespace, moqSubscribe.TrackName, numCaughtUp, errForwardSubscribe))
+				for _, moqSubscribeOk := range moqSession.ValidatePendingTrackSubscriptions(source.TrackKey, cacheOnlyExpiresMs) {
+					moqSession.ForwardSubscribeResponseOk(moqSubscribeOk)
+				}
+			} else if errForwardSubscribe != nil {
+				moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeNoPublishers, ErrMsg: errForwardSubscribe.Error()}
 			}
 		}
 
 		// Send subscribe error if needed
 		if moqSubscribeError.ErrCode != moqhelpers.NoErrorSubscribe {
+			if subscriptionAdded {
+				// Neither counted against the max tracks nor getting objects
+				moqSession.RemoveTrackSubscription(moqobject.NewTrackKey(moqSubscribe.TrackNamespace, moqSubscribe.TrackName))
+			}
 			errMoqTxSubscribeError := moqhelpers.SendSubscribeError(stream, moqSubscribeError)
 			if errMoqTxSubscribeError != nil {
 				// Break session
@@ -263,6 +374,56 @@ func processSubscribe(moqMsg interface{}, stream webtransport.Stream, moqSession
 	return
 }
 
+func answerCatalogSubscribe(moqSubscribe moqhelpers.MoqMessageSubscribe, moqSession *moqsession.MoqSession, catalog *moqcatalog.MoqCatalog) (moqSubscribeError moqhelpers.MoqMessageSubscribeError, errorSessionMoq moqhelpers.MoqError) {
+	cacheKey, found, errCatalog := catalog.Latest(moqSubscribe.TrackNamespace)
+	if errCatalog != nil {
+		// Break session
+		errorSessionMoq.ErrCode = moqhelpers.ErrorGeneric
+		errorSessionMoq.ErrMsg = "Error getting catalog"
+		log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, errorSessionMoq.ErrMsg, errCatalog))
+		return
+	}
+	if !found {
+		moqSubscribeError = moqhelpers.MoqMessageSubscribeError{TrackNamespace: moqSubscribe.TrackNamespace, TrackName: moqSubscribe.TrackName, ErrCode: moqhelpers.ErrorSubscribeNoPublishers, ErrMsg: "No tracks published in namespace"}
+		log.Error(fmt.Sprintf("%s - %s %s", moqSession.UniqueName, moqSubscribeError.ErrMsg, moqSubscribe.TrackNamespace))
+		return
+	}
+	for _, moqSubscribeOk := range moqSession.ValidatePendingTrackSubscriptions(cacheKey.TrackKey, 0) {
+		moqSession.ForwardSubscribeResponseOk(moqSubscribeOk)
+	}
+	// Newer versions arrive as any other object
+	moqSession.ReceivedObject(cacheKey)
+
+	return
+}
+
+func processUnsubscribe(moqMsg interface{}, moqSession *moqsession.MoqSession) (errorSessionMoq moqhelpers.MoqError) {
+	moqUnsubscribe, moqUnsubscribeConv := moqMsg.(moqhelpers.MoqMessageUnsubscribe)
+	if !moqUnsubscribeConv {
+		// Break session
+		errorSessionMoq.ErrCode = moqhelpers.ErrorProtocolViolation
+		errorSessionMoq.ErrMsg = "Error casting UNSUBSCRIBE"
+		log.Error(fmt.Sprintf("%s - %s", moqSession.UniqueName, errorSessionMoq.ErrMsg))
+		return
+	}
+	log.Info(fmt.Sprintf("%s - Received UNSUBSCRIBE message %v", moqSession.UniqueName, moqUnsubscribe))
+
+	if moqSession.Role != moqhelpers.MoqRoleSubscriber {
+		// Break session
+		errorSessionMoq.ErrCode = moqhelpers.ErrorProtocolViolation
+		errorSessionMoq.ErrMsg = "Error received UNSUBSCRIBE from NON subscriber"
+		log.Error(fmt.Sprintf("%s - %s", moqSession.UniqueName, errorSessionMoq.ErrMsg))
+		return
+	}
+
+	// Publishers keep sending, other subscribers can be using the track
+	if !moqSession.RemoveTrackSubscription(moqobject.NewTrackKey(moqUnsubscribe.TrackNamespace, moqUnsubscribe.TrackName)) {
+		log.Warning(fmt.Sprintf("%s - UNSUBSCRIBE for NOT subscribed track %s/%s", moqSession.UniqueName, moqUnsubscribe.TrackNamespace, moqUnsubscribe.TrackName))
+	}
+
+	return
+}
+
 func processSubscribeOk(moqMsg interface{}, stream webtransport.Stream, moqSession *moqsession.MoqSession, moqtFwdTable *moqfwdtable.MoqFwdTable) (errorSessionMoq moqhelpers.MoqError) {
 	moqSubscribeOk, moqSubscribeConv := moqMsg.(moqhelpers.MoqMessageSubscribeOk)
 	if !moqSubscribeConv {
@@ -287,10 +448,8 @@ func processSubscribeOk(moqMsg interface{}, stream webtransport.Stream, moqSessi
 		// Forward and add those subscriptions to sessions
 		errForwardSubscribe := moqtFwdTable.ForwardSubscribeOk(moqSubscribeOk)
 		if errForwardSubscribe != nil {
-			// Break session
-			errorSessionMoq.ErrCode = moqhelpers.ErrorGeneric
-			errorSessionMoq.ErrMsg = errForwardSubscribe.Error()
-			log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, errorSessionMoq.ErrMsg, errForwardSubscribe))
+			// Answer to a SUBSCRIBE already answered (several tracks can get objects from the same publisher track, ex: renditions)
+			log.Warning(fmt.Sprintf("%s - Nothing pending for SUBSCRIBE OK %v. Err: %v", moqSession.UniqueName, moqSubscribeOk, errForwardSubscribe))
 		}
 	}
 
@@ -333,10 +492,8 @@ func processSubscribeError(moqMsg interface{}, stream webtransport.Stream, moqSe
 		// TODO JOC: Forward to subscribers
 		errForwardSubscribe := moqtFwdTable.ForwardSubscribeError(moqSubscribeError)
 		if errForwardSubscribe != nil {
-			// Break session
-			errorSessionMoq.ErrCode = moqhelpers.ErrorGeneric
-			errorSessionMoq.ErrMsg = errForwardSubscribe.Error()
-			log.Error(fmt.Sprintf("%s - %s. Err: %v", moqSession.UniqueName, errorSessionMoq.ErrMsg, errForwardSubscribe))
+			// Answer to a SUBSCRIBE already answered (several tracks can get objects from the same publisher track, ex: renditions)
+			log.Warning(fmt.Sprintf("%s - Nothing pending for SUBSCRIBE Error %v. Err: %v", moqSession.UniqueName, moqSubscribeError, errForwardSubscribe))
 		}
 	}
 	return
@@ -379,7 +536,7 @@ func startForwardSubscribeResponses(stream webtransport.Stream, moqSession *moqs
 			var errSendSubscribe error
 			if subscribeRespType == moqhelpers.MoqIdSubscribeOk {
 				errSendSubscribe = moqhelpers.SendSubscribeOk(stream, subscribeResp.(moqhelpers.MoqMessageSubscribeOk))
-			} else if subscribeRespType == moqhelpers.MoqIdMessageAnnounceError {
+			} else if subscribeRespType == moqhelpers.MoqIdSubscribeError {
 				errSendSubscribe = moqhelpers.SendSubscribeError(stream, subscribeResp.(moqhelpers.MoqMessageSubscribeError))
 			} else {
 				errSendSubscribe = errors.New(fmt.Sprintf("We can NOT forward this message type %d as subscribe response", subscribeRespType))
@@ -395,9 +552,46 @@ func startForwardSubscribeResponses(stream webtransport.Stream, moqSession *moqs
 	log.Info(fmt.Sprintf("%s(-) - Exit Forwarding subscribes thread", moqSession.UniqueName))
 }
 
+// Thread for subscriber (stats track)
+
+func startReportingStats(session *webtransport.Session, moqSession *moqsession.MoqSession, statsIntervalMs uint64) {
+	ticker := time.NewTicker(time.Duration(statsIntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	group := uint64(0)
+	bExit := false
+	for bExit == false {
+		select {
+		case <-session.Context().Done():
+			bExit = true
+		case <-ticker.C:
+			if !moqSession.HasTrackSubscriptionTo(moqsession.STATS_TRACK_NAME) {
+				continue
+			}
+			buf, errMarshal := json.Marshal(moqSession.StatsReport())
+			if errMarshal != nil {
+				log.Error(fmt.Sprintf("%s - Encoding stats. Err: %v", moqSession.UniqueName, errMarshal))
+				continue
+			}
+			// Every report is a new group
+			moqObj := moqobject.New(moqobject.MoqObjectHeader{GroupSequence: group}, 0)
+			moqObj.PayloadWrite(buf)
+			moqObj.SetEof()
+			if moqSession.DeliverRelayObject(moqsession.STATS_TRACK_NAME, moqObj) > 0 {
+				group++
+			}
+			moqObj.Release()
+		}
+	}
+
+	log.Info(fmt.Sprintf("%s(-) - Exit Reporting Stats thread", moqSession.UniqueName))
+
+	return
+}
+
 // Thread for publisher (receive objects)
 
-func startListeningObjects(session *webtransport.Session, moqSession *moqsession.MoqSession, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, objExpMs uint64) {
+func startListeningObjects(session *webtransport.Session, moqSession *moqsession.MoqSession, moqtFwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, objExpMs uint64, trackPolicy *moqtrackpolicy.MoqTrackPolicy, recorder *moqdvr.Recorder, catalog *moqcatalog.MoqCatalog, tenant *moqquota.Tenant) {
 	for {
 		uniStream, errAccUni := session.AcceptUniStream(session.Context())
 		if errAccUni != nil {
@@ -428,24 +622,52 @@ func startListeningObjects(session *webtransport.Session, moqSession *moqsession
 				return
 			}
 
+			if !tenant.IngestAllowed() {
+				log.Error(fmt.Sprintf("%s(%v) - Ingest bitrate quota exceeded for tenant %s, dropping obj: %s", moqSession.UniqueName, (*uniStream).StreamID(), tenant.Name, moqObjHeader.GetDebugStr()))
+				(*uniStream).CancelRead(webtransport.StreamErrorCode(moqhelpers.ErrorQuotaExceeded))
+				return
+			}
+
+			// Opaque tracks keep a single copy, LOC tracks one per rendition of their ladder
+			mode := trackPolicy.ModeFor(trackNamespace, trackName)
+			ladder := trackPolicy.LadderFor(mode, trackNamespace, trackName)
+
 			// Create cache key
 			cacheKey := createObjectCacheKey(trackNamespace, trackName, moqObjHeader)
-			moqObj, errAddingMoqObj := objects.Create(cacheKey, moqObjHeader, objExpMs/1000)
+			moqObj, errAddingMoqObj := objects.Create(cacheKey, moqObjHeader, objExpMs/1000, ladder.Bitrates())
 			if errAddingMoqObj != nil {
 				log.Error(fmt.Sprintf("%s(%v) - Received obj error, key: %s, Obj header: %s. Err: %v", moqSession.UniqueName, (*uniStream).StreamID(), cacheKey, moqObjHeader.GetDebugStr(), errAddingMoqObj))
-			} else {
-				log.Info(fmt.Sprintf("%s(%v) - Received obj header, key: %s, Obj: %s", moqSession.UniqueName, (*uniStream).StreamID(), cacheKey, moqObjHeader.GetDebugStr()))
+				(*uniStream).CancelRead(webtransport.StreamErrorCode(moqhelpers.ErrorGeneric))
+				return
 			}
+			log.Info(fmt.Sprintf("%s(%v) - Received obj header, key: %s, Obj: %s, mode: %s", moqSession.UniqueName, (*uniStream).StreamID(), cacheKey, moqObjHeader.GetDebugStr(), mode))
 
 			// Notify new cache key
-			moqtFwdTable.ReceivedObject(cacheKey)
+			notifyObject := func() {
+				moqtFwdTable.ReceivedObject(cacheKey)
+			}
 
-			errObjPayload := moqhelpers.ReadObjPayloadToEOS(*uniStream, moqObj)
+			var (
+				received      int
+				mediaType     string
+				errObjPayload error
+			)
+			if mode == moqtrackpolicy.ModeOpaque {
+				notifyObject()
+				received, errObjPayload = moqhelpers.ReadOpaquePayloadToEOS(*uniStream, moqObj[ladder.Source().Bitrate])
+			} else {
+				// Once the LOC header is decoded, so subscribers know if it is a key chunk when choosing the rendition
+				received, mediaType, errObjPayload = moqhelpers.ReadObjPayloadToEOS(*uniStream, moqObj, ladder, trackPolicy.EncoderFor(trackNamespace, trackName), notifyObject)
+			}
+			tenant.ConsumeIngest(received)
 			if errObjPayload != nil {
 				log.Error(fmt.Sprintf("%s(%v) - Error receiving obj payload. Err: %v", moqSession.UniqueName, (*uniStream).StreamID(), errObjPayload))
 				return
 			}
-			log.Info(fmt.Sprintf("%s(%v) - Received obj, Obj: %s", moqSession.UniqueName, (*uniStream).StreamID(), moqObj[awt.EncoderSettings[0].Bitrate].GetDebugStr()))
+			log.Info(fmt.Sprintf("%s(%v) - Received obj, Obj: %s, bytes: %d", moqSession.UniqueName, (*uniStream).StreamID(), moqObjHeader.GetDebugStr(), received))
+
+			catalog.TrackSeen(moqSession.UniqueName, cacheKey.TrackKey, mode, mediaType)
+			recorder.Record(cacheKey, mode, moqObj[ladder.Source().Bitrate])
 
 		}(&uniStream, session, moqtFwdTable)
 	}
@@ -454,40 +676,48 @@ func startListeningObjects(session *webtransport.Session, moqSession *moqsession
 	return
 }
 
-func startForwardingObjects(session *webtransport.Session, moqSession *moqsession.MoqSession, objects *moqmessageobjects.MoqMessageObjects) {
-	var (
-		err error
-	)
+func startForwardingObjects(session *webtransport.Session, moqSession *moqsession.MoqSession, objects *moqmessageobjects.MoqMessageObjects, trackPolicy *moqtrackpolicy.MoqTrackPolicy, tenant *moqquota.Tenant, shaper *awt.Shaper) {
 	bExit := false
 	for bExit == false {
 		// Get next object cache key
-		cacheKey := moqSession.GetNewObject()
-		if cacheKey == "" {
+		delivery, stop := moqSession.GetNewObject()
+		if stop {
 			bExit = true
 		} else {
-			moqObj, found := objects.Get(cacheKey, moqSession.GetETP())
+			moqObj, found := delivery.Object, delivery.Object != nil
+			if !found {
+				// Rendition tracks always get their bitrate, the rest the one chosen by the ABR policy (server side ABR)
+				sourceKey := delivery.CacheKey.TrackKey
+				ladder := trackPolicy.LadderFor(trackPolicy.ModeFor(sourceKey.Namespace, sourceKey.Name), sourceKey.Namespace, sourceKey.Name)
+				bitrate := moqSession.ChooseRendition(delivery, ladder.Bitrates(), objects.IsKeyChunk(delivery.CacheKey))
+				moqObj, found = objects.Get(delivery.CacheKey, bitrate)
+			}
 			if !found {
-				log.Error(fmt.Sprintf("%s - Not found OBJECT key %s in cache", moqSession.UniqueName, cacheKey))
+				log.Error(fmt.Sprintf("%s - Not found OBJECT key %s in cache", moqSession.UniqueName, delivery.CacheKey))
+			} else if !tenant.EgressAllowed() {
+				log.Error(fmt.Sprintf("%s - Egress bitrate quota exceeded for tenant %s, dropping OBJECT key %s", moqSession.UniqueName, tenant.Name, delivery.CacheKey))
+				moqObj.Release()
 			} else {
-				go func(moqObj *moqobject.MoqObject, session *webtransport.Session, moqSession *moqsession.MoqSession) {
+				moqSession.StartedSendingObject()
+				go func(moqObj *moqobject.MoqObject, trackId uint64, session *webtransport.Session, moqSession *moqsession.MoqSession) {
+					defer moqSession.FinishedSendingObject()
+					defer moqObj.Release()
+
 					sUni, errOpenStream := session.OpenUniStreamSync(session.Context())
 					if errOpenStream != nil {
 						log.Error(fmt.Sprintf("%s(-) - Opening stream to send OBJECT %s", moqSession.UniqueName, moqObj.GetDebugStr()))
 					} else {
 						log.Info(fmt.Sprintf("%s(%v) - Sending OBJECT %s", moqSession.UniqueName, sUni.StreamID(), moqObj.GetDebugStr()))
-						errSendObj := moqhelpers.SendObject(sUni, moqObj)
+						errSendObj := moqhelpers.SendObject(session.Context(), shaper.Writer(session.Context(), sUni), trackId, moqObj)
 						if errSendObj != nil {
 							log.Error(fmt.Sprintf("%s(%v) - Sending OBJECT %s. Err: %v", moqSession.UniqueName, sUni.StreamID(), moqObj.GetDebugStr(), errSendObj))
 						} else {
 							log.Info(fmt.Sprintf("%s(%v) - Sent OBJECT %s", moqSession.UniqueName, sUni.StreamID(), moqObj.GetDebugStr()))
 						}
 						sUni.Close()
-
-						if err = moqSession.CalculateETP(uint64(sUni.StreamID()), moqObj.Len()); err != nil {
-							log.Debug("failed to calculate ETP")
-						}
+						tenant.ConsumeEgress(moqObj.Len())
 					}
-				}(moqObj, session, moqSession)
+				}(moqObj, delivery.TrackId, session, moqSession)
 			}
 		}
 	}
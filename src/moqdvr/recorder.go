@@ -0,0 +1,256 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqdvr
+
+import (
+	"context"
+	"encoding/json"
+	"facebookexperimental/moq-go-server/moqauth"
+	"facebookexperimental/moq-go-server/moqobject"
+	"facebookexperimental/moq-go-server/moqtrackpolicy"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const RECORDER_QUEUE_SIZE = 1024
+
+// Files of a recording directory
+const TRACK_FILE_NAME = "track.json"
+const INDEX_FILE_NAME = "index.jsonl"
+const PAYLOAD_FILE_NAME = "payload.bin"
+
+// Recorded track (track.json)
+type TrackInfo struct {
+	Namespace string              `json:"namespace"`
+	Name      string              `json:"name"`
+	Mode      moqtrackpolicy.Mode `json:"mode"`
+	StartedAt time.Time           `json:"started_at"`
+}
+
+// Recorded object (one line of index.jsonl), the payload is in payload.bin at Offset
+type IndexEntry struct {
+	TrackId   uint64 `json:"track_id"`
+	Group     uint64 `json:"group"`
+	Object    uint64 `json:"object"`
+	SendOrder uint64 `json:"send_order"`
+
+	// Arrival time since the recording started (in microseconds)
+	ArrivalUs int64 `json:"arrival_us"`
+
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+type recordRequest struct {
+	cacheKey moqobject.CacheKey
+	mode     moqtrackpolicy.Mode
+	obj      *moqobject.MoqObject
+}
+
+type trackRecording struct {
+	info    TrackInfo
+	index   *os.File
+	payload *os.File
+	offset  int64
+}
+
+// Records completed objects of the selected tracks under dir/<namespace>/<track>/<start time ms>
+type Recorder struct {
+	dir string
+
+	// Namespace and track patterns (see moqauth.MatchNamespace), no track patterns means all tracks
+	namespacePatterns []string
+	trackPatterns     []string
+
+	// Only used by the writer thread
+	recordings map[moqobject.TrackKey]*trackRecording
+
+	recordChannel chan recordRequest
+	stopChannel   chan bool
+}
+
+func NewRecorder(dir string, namespacePatterns []string, trackPatterns []string) (r *Recorder, err error) {
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return
+	}
+
+	r = &Recorder{dir: dir, namespacePatterns: namespacePatterns, trackPatterns: trackPatterns, recordings: map[moqobject.TrackKey]*trackRecording{}, recordChannel: make(chan recordRequest, RECORDER_QUEUE_SIZE), stopChannel: make(chan bool)}
+	go r.runWriter()
+
+	log.Info(fmt.Sprintf("Started DVR recorder at %s, namespaces: %v, tracks: %v", dir, namespacePatterns, trackPatterns))
+
+	return
+}
+
+func (r *Recorder) Matches(trackKey moqobject.TrackKey) bool {
+	if r == nil || !matchAny(r.namespacePatterns, trackKey.Namespace) {
+		return false
+	}
+	return len(r.trackPatterns) <= 0 || matchAny(r.trackPatterns, trackKey.Name)
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if moqauth.MatchNamespace(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Queues a completed object (source rendition) to be recorded, the payload is kept until written
+func (r *Recorder) Record(cacheKey moqobject.CacheKey, mode moqtrackpolicy.Mode, obj *moqobject.MoqObject) {
+	if !r.Matches(cacheKey.TrackKey) {
+		return
+	}
+	obj.Retain()
+
+	select {
+	case r.recordChannel <- recordRequest{cacheKey: cacheKey, mode: mode, obj: obj}:
+	default:
+		log.Warn(fmt.Sprintf("DVR recorder queue full, dropping: %s", cacheKey))
+		obj.Release()
+	}
+}
+
+func (r *Recorder) Stop() {
+	// Send finish signal
+	r.stopChannel <- true
+
+	// Wait to finish
+	<-r.stopChannel
+}
+
+func (r *Recorder) runWriter() {
+	exit := false
+	for !exit {
+		select {
+		case req := <-r.recordChannel:
+			r.record(req)
+
+		case <-r.stopChannel:
+			exit = true
+		}
+	}
+	// Queued before stopping
+	for drained := false; !drained; {
+		select {
+		case req := <-r.recordChannel:
+			r.record(req)
+		default:
+			drained = true
+		}
+	}
+	for _, recording := range r.recordings {
+		recording.index.Close()
+		recording.payload.Close()
+	}
+
+	// Indicates finished
+	r.stopChannel <- true
+
+	log.Info("Stopped DVR recorder")
+}
+
+func (r *Recorder) record(req recordRequest) {
+	if err := r.write(req); err != nil {
+		log.Error(fmt.Sprintf("DVR recording %s. Err: %v", req.cacheKey, err))
+	}
+	req.obj.Release()
+}
+
+func (r *Recorder) write(req recordRequest) (err error) {
+	var (
+		size    int64
+		indexLn []byte
+	)
+
+	recording, found := r.recordings[req.cacheKey.TrackKey]
+	if !found {
+		if recording, err = r.startRecording(req.cacheKey.TrackKey, req.mode, req.obj.ReceivedAt); err != nil {
+			return
+		}
+		r.recordings[req.cacheKey.TrackKey] = recording
+	}
+
+	reader := req.obj.NewReader(context.Background())
+	size, err = io.Copy(recording.payload, reader)
+	reader.Close()
+	if err != nil {
+		// Drop the partial payload, so the next offsets are right
+		if errTruncate := recording.truncate(); errTruncate != nil {
+			log.Error(fmt.Sprintf("DVR truncating %s. Err: %v", req.cacheKey, errTruncate))
+			recording.offset += size
+		}
+		return
+	}
+
+	entry := IndexEntry{TrackId: req.obj.TrackId, Group: req.cacheKey.Group, Object: req.cacheKey.Object, SendOrder: req.obj.SendOrder, ArrivalUs: req.obj.ReceivedAt.Sub(recording.info.StartedAt).Microseconds(), Offset: recording.offset, Size: size}
+	recording.offset += size
+	if indexLn, err = json.Marshal(entry); err != nil {
+		return
+	}
+	_, err = recording.index.Write(append(indexLn, '\n'))
+
+	return
+}
+
+// Removes the payload written after offset
+func (recording *trackRecording) truncate() (err error) {
+	if err = recording.payload.Truncate(recording.offset); err != nil {
+		return
+	}
+	_, err = recording.payload.Seek(recording.offset, io.SeekStart)
+	return
+}
+
+// Escaped name of a path component, "." and ".." are escaped too so recordings can NOT be outside the dir
+func pathComponent(name string) string {
+	escaped := url.PathEscape(name)
+	if escaped == "." || escaped == ".." {
+		return strings.ReplaceAll(escaped, ".", "%2E")
+	}
+	return escaped
+}
+
+func (r *Recorder) startRecording(trackKey moqobject.TrackKey, mode moqtrackpolicy.Mode, startedAt time.Time) (recording *trackRecording, err error) {
+	var (
+		infoBuf []byte
+	)
+
+	recordingDir := filepath.Join(r.dir, pathComponent(trackKey.Namespace), pathComponent(trackKey.Name), strconv.FormatInt(startedAt.UnixMilli(), 10))
+	if err = os.MkdirAll(recordingDir, os.ModePerm); err != nil {
+		return
+	}
+
+	recording = &trackRecording{info: TrackInfo{Namespace: trackKey.Namespace, Name: trackKey.Name, Mode: mode, StartedAt: startedAt}}
+	if infoBuf, err = json.MarshalIndent(recording.info, "", "  "); err != nil {
+		return
+	}
+	if err = os.WriteFile(filepath.Join(recordingDir, TRACK_FILE_NAME), infoBuf, 0644); err != nil {
+		return
+	}
+	if recording.index, err = os.Create(filepath.Join(recordingDir, INDEX_FILE_NAME)); err != nil {
+		return
+	}
+	if recording.payload, err = os.Create(filepath.Join(recordingDir, PAYLOAD_FILE_NAME)); err != nil {
+		recording.index.Close()
+		return
+	}
+
+	log.Info(fmt.Sprintf("Started DVR recording of %s at %s", trackKey, recordingDir))
+
+	return
+}
@@ -0,0 +1,232 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqdvr
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"facebookexperimental/moq-go-server/awt"
+	"facebookexperimental/moq-go-server/moqcatalog"
+	"facebookexperimental/moq-go-server/moqencoder"
+	"facebookexperimental/moq-go-server/moqfwdtable"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqmessageobjects"
+	"facebookexperimental/moq-go-server/moqobject"
+	"facebookexperimental/moq-go-server/moqsession"
+	"facebookexperimental/moq-go-server/moqtrackpolicy"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Replays a recording as a virtual publisher: its session announces the recorded namespace in
+// the forward table, answers SUBSCRIBE for the recorded track and ingests the recorded objects
+// with the original pacing (divided by speed)
+type Replay struct {
+	dir     string
+	info    TrackInfo
+	entries []IndexEntry
+	payload *os.File
+
+	// Renditions of the recorded track, and how they are generated (LOC recordings)
+	ladder  awt.EncoderLadder
+	encoder moqencoder.Encoder
+
+	// Pacing factor (2 = twice as fast), 0 means no pacing
+	speed float64
+	// Start again after the last object (groups keep increasing)
+	loop bool
+
+	objExpS  uint64
+	session  *moqsession.MoqSession
+	fwdTable *moqfwdtable.MoqFwdTable
+	objects  *moqmessageobjects.MoqMessageObjects
+	catalog  *moqcatalog.MoqCatalog
+
+	cancel context.CancelFunc
+	done   chan bool
+}
+
+func StartReplay(dir string, speed float64, loop bool, fwdTable *moqfwdtable.MoqFwdTable, objects *moqmessageobjects.MoqMessageObjects, objExpMs uint64, trackPolicy *moqtrackpolicy.MoqTrackPolicy, catalog *moqcatalog.MoqCatalog) (rp *Replay, err error) {
+	var (
+		infoBuf []byte
+		ctx     context.Context
+	)
+
+	if speed < 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid replay speed %f", speed))
+	}
+	if speed <= 0 && loop {
+		// Without pacing it would fill the cache with new groups forever
+		return nil, errors.New("Looped replays need pacing (speed > 0)")
+	}
+
+	rp = &Replay{dir: dir, speed: speed, loop: loop, objExpS: objExpMs / 1000, fwdTable: fwdTable, objects: objects, catalog: catalog, done: make(chan bool)}
+
+	if infoBuf, err = os.ReadFile(filepath.Join(dir, TRACK_FILE_NAME)); err != nil {
+		return
+	}
+	if err = json.Unmarshal(infoBuf, &rp.info); err != nil {
+		err = errors.New(fmt.Sprintf("Parsing %s, err: %v", filepath.Join(dir, TRACK_FILE_NAME), err))
+		return
+	}
+	rp.ladder = trackPolicy.LadderFor(rp.info.Mode, rp.info.Namespace, rp.info.Name)
+	rp.encoder = trackPolicy.EncoderFor(rp.info.Namespace, rp.info.Name)
+	if rp.entries, err = readIndex(filepath.Join(dir, INDEX_FILE_NAME)); err != nil {
+		return
+	}
+	if len(rp.entries) <= 0 {
+		err = errors.New(fmt.Sprintf("Empty recording %s", dir))
+		return
+	}
+	if rp.payload, err = os.Open(filepath.Join(dir, PAYLOAD_FILE_NAME)); err != nil {
+		return
+	}
+
+	rp.session = moqsession.New(fmt.Sprintf("dvr-replay/%s", dir), moqhelpers.MoqVersionDraft01, moqhelpers.MoqRolePublisher, nil)
+	if err = rp.session.AddTrackNamespace(moqhelpers.MoqMessageAnnounce{TrackNamespace: rp.info.Namespace}); err != nil {
+		rp.payload.Close()
+		return
+	}
+	if err = fwdTable.AddSession(rp.session); err != nil {
+		rp.payload.Close()
+		return
+	}
+
+	ctx, rp.cancel = context.WithCancel(context.Background())
+	go rp.answerSubscribes()
+	go rp.run(ctx)
+
+	log.Info(fmt.Sprintf("Started DVR replay of %s/%s from %s, objects: %d, speed: %f, loop: %t", rp.info.Namespace, rp.info.Name, dir, len(rp.entries), speed, loop))
+
+	return
+}
+
+func readIndex(path string) (entries []IndexEntry, err error) {
+	var (
+		file *os.File
+	)
+
+	if file, err = os.Open(path); err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry IndexEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			err = errors.New(fmt.Sprintf("Parsing %s, err: %v", path, err))
+			return
+		}
+		entries = append(entries, entry)
+	}
+	err = scanner.Err()
+
+	return
+}
+
+func (rp *Replay) Stop() {
+	rp.cancel()
+	<-rp.done
+
+	// Also stops the session threads
+	rp.fwdTable.RemoveSession(rp.session.UniqueName)
+	rp.catalog.PublisherGone(rp.session.UniqueName)
+	rp.payload.Close()
+
+	log.Info(fmt.Sprintf("Stopped DVR replay from %s", rp.dir))
+}
+
+// The relay is the publisher of the recorded track, so it answers SUBSCRIBE itself
+func (rp *Replay) answerSubscribes() {
+	for {
+		subscribe, stop := rp.session.GetNewSubscribe()
+		if stop {
+			break
+		}
+		if subscribe.TrackNamespace != rp.info.Namespace || subscribe.TrackName != rp.info.Name {
+			// Other tracks of the namespace can be answered by other publishers
+			continue
+		}
+		subscribeOk := moqhelpers.MoqMessageSubscribeOk{TrackNamespace: rp.info.Namespace, TrackName: rp.info.Name, TrackId: rp.entries[0].TrackId, Expires: 0}
+		if err := rp.fwdTable.ForwardSubscribeOk(subscribeOk); err != nil {
+			log.Error(fmt.Sprintf("%s - Answering SUBSCRIBE for %s/%s. Err: %v", rp.session.UniqueName, rp.info.Namespace, rp.info.Name, err))
+		}
+	}
+}
+
+func (rp *Replay) run(ctx context.Context) {
+	defer close(rp.done)
+
+	groupOffset := uint64(0)
+	for {
+		start := time.Now()
+		lastGroup := uint64(0)
+		for _, entry := range rp.entries {
+			if rp.speed > 0 {
+				at := start.Add(time.Duration(float64(entry.ArrivalUs)/rp.speed) * time.Microsecond)
+				select {
+				case <-time.After(time.Until(at)):
+				case <-ctx.Done():
+					return
+				}
+			} else if ctx.Err() != nil {
+				return
+			}
+			rp.ingest(entry, groupOffset)
+			lastGroup = max(lastGroup, entry.Group)
+		}
+		if !rp.loop {
+			break
+		}
+		// Groups can NOT be repeated in the cache
+		groupOffset += lastGroup + 1
+	}
+
+	log.Info(fmt.Sprintf("%s - Finished DVR replay", rp.session.UniqueName))
+}
+
+// Same as an object received from a publisher
+func (rp *Replay) ingest(entry IndexEntry, groupOffset uint64) {
+	var (
+		mediaType  string
+		errPayload error
+	)
+
+	objHeader := moqobject.MoqObjectHeader{TrackId: entry.TrackId, GroupSequence: entry.Group + groupOffset, ObjectSequence: entry.Object, SendOrder: entry.SendOrder}
+	cacheKey := moqobject.NewCacheKey(moqobject.NewTrackKey(rp.info.Namespace, rp.info.Name), objHeader)
+
+	moqObjs, err := rp.objects.Create(cacheKey, objHeader, rp.objExpS, rp.ladder.Bitrates())
+	if err != nil {
+		log.Error(fmt.Sprintf("%s - Replaying obj, key: %s. Err: %v", rp.session.UniqueName, cacheKey, err))
+		return
+	}
+	notifyObject := func() {
+		rp.fwdTable.ReceivedObject(cacheKey)
+	}
+
+	payload := io.NewSectionReader(rp.payload, entry.Offset, entry.Size)
+	if rp.info.Mode == moqtrackpolicy.ModeOpaque {
+		notifyObject()
+		_, errPayload = moqhelpers.ReadOpaquePayloadToEOS(payload, moqObjs[rp.ladder.Source().Bitrate])
+	} else {
+		_, mediaType, errPayload = moqhelpers.ReadObjPayloadToEOS(payload, moqObjs, rp.ladder, rp.encoder, notifyObject)
+	}
+	if errPayload != nil {
+		log.Error(fmt.Sprintf("%s - Replaying obj payload, key: %s. Err: %v", rp.session.UniqueName, cacheKey, errPayload))
+		return
+	}
+	rp.catalog.TrackSeen(rp.session.UniqueName, cacheKey.TrackKey, rp.info.Mode, mediaType)
+	log.Debug(fmt.Sprintf("%s - Replayed obj, key: %s", rp.session.UniqueName, cacheKey))
+}
@@ -0,0 +1,113 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqencoder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"facebookexperimental/moq-go-server/awt"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Max stderr bytes added to errors
+const EXTERNAL_PROCESS_MAX_ERR_LEN = 512
+
+// Runs a process per rendition, the source payload is written to its stdin and the rendition
+// is read from its stdout. The command line is split in spaces and then these placeholders are
+// replaced in every argument: {bitrate}, {maxrate}, {bufsize} (kbps) and {resolution}
+// Example: ffmpeg -i pipe:0 -preset ultrafast -f matroska -s {resolution} -b:v {bitrate}k -maxrate {maxrate}k -bufsize {bufsize}k -an pipe:1
+type ExternalProcessEncoder struct {
+	name    string
+	command []string
+
+	// Max duration of every encode, waiting for a slot included (0 = no limit)
+	timeout time.Duration
+
+	// Slots of processes running at the same time
+	running chan struct{}
+}
+
+func NewExternalProcess(name string, commandTemplate string, timeout time.Duration, maxProcesses int) (e *ExternalProcessEncoder, err error) {
+	command := strings.Fields(commandTemplate)
+	if len(command) <= 0 {
+		err = errors.New("Empty external encoder command")
+		return
+	}
+	if maxProcesses <= 0 {
+		err = errors.New(fmt.Sprintf("Max external encoder processes must be positive, got %d", maxProcesses))
+		return
+	}
+	e = &ExternalProcessEncoder{name: name, command: command, timeout: timeout, running: make(chan struct{}, maxProcesses)}
+	return
+}
+
+func (e *ExternalProcessEncoder) Name() string {
+	return e.name
+}
+
+func (e *ExternalProcessEncoder) Encode(chunk []byte, quality awt.EncoderQuality) (eChunk []byte, err error) {
+	var (
+		output, errOut bytes.Buffer
+		ctx            context.Context = context.Background()
+	)
+
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+
+	// Wait for a free slot, the timeout also covers the wait
+	select {
+	case e.running <- struct{}{}:
+		defer func() { <-e.running }()
+	case <-ctx.Done():
+		err = errors.New(fmt.Sprintf("Waiting for a free %s process slot (%d running), err: %v", e.name, cap(e.running), ctx.Err()))
+		return
+	}
+
+	args := e.args(quality)
+	command := exec.CommandContext(ctx, args[0], args[1:]...)
+	command.Stdin = bytes.NewReader(chunk)
+	command.Stdout = &output
+	command.Stderr = &errOut
+
+	if err = command.Run(); err != nil {
+		errMsg := errOut.String()
+		if len(errMsg) > EXTERNAL_PROCESS_MAX_ERR_LEN {
+			errMsg = errMsg[len(errMsg)-EXTERNAL_PROCESS_MAX_ERR_LEN:]
+		}
+		err = errors.New(fmt.Sprintf("Running %s, err: %v, stderr: %s", args[0], err, strings.TrimSpace(errMsg)))
+		return
+	}
+	if output.Len() <= 0 {
+		err = errors.New(fmt.Sprintf("Running %s, empty output", args[0]))
+		return
+	}
+	eChunk = output.Bytes()
+
+	return
+}
+
+func (e *ExternalProcessEncoder) args(quality awt.EncoderQuality) []string {
+	replacer := strings.NewReplacer(
+		"{bitrate}", strconv.FormatUint(quality.Bitrate, 10),
+		"{maxrate}", strconv.FormatUint(quality.MaxRate, 10),
+		"{bufsize}", strconv.FormatUint(quality.BufSize, 10),
+		"{resolution}", quality.Resolution,
+	)
+	args := make([]string, len(e.command))
+	for i, arg := range e.command {
+		args[i] = replacer.Replace(arg)
+	}
+	return args
+}
@@ -0,0 +1,31 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqencoder
+
+import (
+	"facebookexperimental/moq-go-server/awt"
+	"fmt"
+)
+
+// Deterministic encoder for tests: the rendition is the source payload prefixed with the
+// quality ("<resolution>@<bitrate>k:"), so every rendition is different and recognizable
+type FakeEncoder struct{}
+
+func NewFake() *FakeEncoder {
+	return &FakeEncoder{}
+}
+
+func (e *FakeEncoder) Name() string {
+	return FAKE_NAME
+}
+
+func (e *FakeEncoder) Encode(chunk []byte, quality awt.EncoderQuality) ([]byte, error) {
+	prefix := fmt.Sprintf("%s@%dk:", quality.Resolution, quality.Bitrate)
+	eChunk := make([]byte, 0, len(prefix)+len(chunk))
+	eChunk = append(eChunk, prefix...)
+	return append(eChunk, chunk...), nil
+}
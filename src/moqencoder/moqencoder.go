@@ -0,0 +1,68 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqencoder
+
+import (
+	"errors"
+	"facebookexperimental/moq-go-server/awt"
+	"fmt"
+	"sync"
+)
+
+// Names of the built in encoders
+const (
+	PASSTHROUGH_NAME      = "passthrough"
+	FAKE_NAME             = "fake"
+	EXTERNAL_PROCESS_NAME = "external"
+)
+
+const DEFAULT_ENCODER = PASSTHROUGH_NAME
+
+// Encoder generates a rendition from a complete LOC payload (media data only, headers are
+// handled by the caller). It is called concurrently for every rendition of an object, so
+// it can NOT modify chunk and it needs to be safe for concurrent use
+type Encoder interface {
+	Name() string
+	Encode(chunk []byte, quality awt.EncoderQuality) ([]byte, error)
+}
+
+// Encoders available by name
+type Registry struct {
+	encoders map[string]Encoder
+
+	lock *sync.RWMutex
+}
+
+// NewRegistry Creates a registry with the passthrough and fake encoders
+func NewRegistry() *Registry {
+	r := &Registry{encoders: map[string]Encoder{}, lock: new(sync.RWMutex)}
+	r.Register(NewPassthrough())
+	r.Register(NewFake())
+	return r
+}
+
+func (r *Registry) Register(encoder Encoder) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, found := r.encoders[encoder.Name()]; found {
+		return errors.New(fmt.Sprintf("Encoder %s already registered", encoder.Name()))
+	}
+	r.encoders[encoder.Name()] = encoder
+	return nil
+}
+
+func (r *Registry) Get(name string) (encoder Encoder, err error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	encoder, found := r.encoders[name]
+	if !found {
+		err = errors.New(fmt.Sprintf("Encoder %s NOT registered", name))
+	}
+	return
+}
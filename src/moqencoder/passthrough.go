@@ -0,0 +1,27 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqencoder
+
+import (
+	"facebookexperimental/moq-go-server/awt"
+)
+
+// Every rendition is the source payload
+type PassthroughEncoder struct{}
+
+func NewPassthrough() *PassthroughEncoder {
+	return &PassthroughEncoder{}
+}
+
+func (e *PassthroughEncoder) Name() string {
+	return PASSTHROUGH_NAME
+}
+
+// Returns chunk itself, it is only read afterwards
+func (e *PassthroughEncoder) Encode(chunk []byte, quality awt.EncoderQuality) ([]byte, error) {
+	return chunk, nil
+}
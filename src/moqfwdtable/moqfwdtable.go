@@ -9,6 +9,7 @@ package moqfwdtable
 import (
 	"errors"
 	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqobject"
 	"facebookexperimental/moq-go-server/moqsession"
 	"fmt"
 	"sync"
@@ -17,13 +18,16 @@ import (
 type MoqFwdTable struct {
 	sessions map[string]*moqsession.MoqSession
 
+	// Max expiry (in ms) the relay grants to subscribers (0 = no limit)
+	maxSubscriptionExpiresMs uint64
+
 	// FilesLock Lock used to write / read files
 	lock *sync.RWMutex
 }
 
 // New Creates a new moq forward table
-func New() *MoqFwdTable {
-	mft := MoqFwdTable{sessions: map[string]*moqsession.MoqSession{}, lock: new(sync.RWMutex)}
+func New(maxSubscriptionExpiresMs uint64) *MoqFwdTable {
+	mft := MoqFwdTable{sessions: map[string]*moqsession.MoqSession{}, maxSubscriptionExpiresMs: maxSubscriptionExpiresMs, lock: new(sync.RWMutex)}
 
 	return &mft
 }
@@ -59,12 +63,12 @@ func (mft *MoqFwdTable) RemoveSession(sessionName string) (err error) {
 	return err
 }
 
-func (mft *MoqFwdTable) ReceivedObject(cacheKey string) (err error) {
+func (mft *MoqFwdTable) ReceivedObject(cacheKey moqobject.CacheKey) (err error) {
 	mft.lock.RLock()
 	defer mft.lock.RUnlock()
 
 	for _, session := range mft.sessions {
-		if session.Role == moqhelpers.MoqRoleSubscriber && session.NeedsToBeDForwarded(cacheKey) {
+		if session.Role == moqhelpers.MoqRoleSubscriber {
 			session.ReceivedObject(cacheKey)
 		}
 	}
@@ -97,25 +101,39 @@ func (mft *MoqFwdTable) ForwardSubscribeOk(subscribeOk moqhelpers.MoqMessageSubs
 	mft.lock.RLock()
 	defer mft.lock.RUnlock()
 
+	// The relay answers subscribers with its own expiry, never longer than the publisher one
+	expires := mft.subscriptionExpires(subscribeOk.Expires)
+	source := moqobject.NewTrackKey(subscribeOk.TrackNamespace, subscribeOk.TrackName)
+
 	// TODO: Moqbug I need a way to identify the subscribe answer from publisher to source subscriber session
-	// Here is sending OK to all subscribed
+	// Here is sending OK to all subscribed (one per track that gets objects from the publisher one, ex: renditions)
 	for _, session := range mft.sessions {
 		if session.Role == moqhelpers.MoqRoleSubscriber {
-			updated := session.HasPendingTrackSubscriptionUpdate(subscribeOk.TrackNamespace, subscribeOk.TrackName, subscribeOk.TrackId, subscribeOk.Expires)
-			if updated {
-				session.ForwardSubscribeResponseOk(subscribeOk)
+			for _, subscribeOkDownstream := range session.ValidatePendingTrackSubscriptions(source, expires) {
+				session.ForwardSubscribeResponseOk(subscribeOkDownstream)
 				anyUpdatedPublishers = true
 			}
 		}
 	}
 
 	if !anyUpdatedPublishers {
-		err = errors.New(fmt.Sprintf("We could NOT find any publishers for %v", subscribeOk.TrackNamespace))
+		err = errors.New(fmt.Sprintf("We could NOT find any pending subscriptions for %s", source))
 	}
 
 	return
 }
 
+// Expiry (in ms, 0 = never) to announce downstream given the publisher one
+func (mft *MoqFwdTable) subscriptionExpires(publisherExpiresMs uint64) uint64 {
+	if mft.maxSubscriptionExpiresMs == 0 {
+		return publisherExpiresMs
+	}
+	if publisherExpiresMs == 0 || publisherExpiresMs > mft.maxSubscriptionExpiresMs {
+		return mft.maxSubscriptionExpiresMs
+	}
+	return publisherExpiresMs
+}
+
 func (mft *MoqFwdTable) ForwardSubscribeError(subscribeError moqhelpers.MoqMessageSubscribeError) (err error) {
 	anyDeletedPublishers := false
 	mft.lock.RLock()
@@ -125,16 +143,17 @@ func (mft *MoqFwdTable) ForwardSubscribeError(subscribeError moqhelpers.MoqMessa
 	// Here is sending OK to all subscribed
 	for _, session := range mft.sessions {
 		if session.Role == moqhelpers.MoqRoleSubscriber {
-			deleted := session.HasPendingTrackSubscriptionDelete(subscribeError.TrackNamespace, subscribeError.TrackName)
-			if deleted {
-				session.ForwardSubscribeResponseError(subscribeError)
+			for _, trackKey := range session.DeleteTrackSubscriptions(moqobject.NewTrackKey(subscribeError.TrackNamespace, subscribeError.TrackName)) {
+				subscribeErrorDownstream := subscribeError
+				subscribeErrorDownstream.TrackName = trackKey.Name
+				session.ForwardSubscribeResponseError(subscribeErrorDownstream)
 				anyDeletedPublishers = true
 			}
 		}
 	}
 
 	if !anyDeletedPublishers {
-		err = errors.New(fmt.Sprintf("We could NOT find any publishers for %v", subscribeError.TrackNamespace))
+		err = errors.New(fmt.Sprintf("We could NOT find any pending subscriptions for %s/%s", subscribeError.TrackNamespace, subscribeError.TrackName))
 	}
 
 	return
@@ -7,8 +7,10 @@ LICENSE file in the root directory of this source tree.
 package moqhelpers
 
 import (
+	"context"
 	"errors"
 	"facebookexperimental/moq-go-server/awt"
+	"facebookexperimental/moq-go-server/moqencoder"
 	"facebookexperimental/moq-go-server/moqhelpers/quichelpers"
 	"facebookexperimental/moq-go-server/moqobject"
 	"fmt"
@@ -21,6 +23,14 @@ import (
 
 const READ_BLOCK_SIZE_BYTES = 1024
 
+// Reused payload read blocks
+var readBlockPool = sync.Pool{
+	New: func() any {
+		block := make([]byte, READ_BLOCK_SIZE_BYTES)
+		return &block
+	},
+}
+
 const MAX_PROTOCOL_VERSIONS = 10
 const MAX_PARAMS = 256
 const MOQ_MAX_STRING_LENGTH = 1024
@@ -41,6 +51,9 @@ const (
 	MoqParamsRole              MoqParams = 0x0
 	MoqParamsPath              MoqParams = 0x1
 	MoqParamsAuthorizationInfo MoqParams = 0x2
+
+	// Relay extension (NOT in the draft), SUBSCRIBE ABR policy spec (see moqabr.New)
+	MoqParamsAbrPolicy MoqParams = 0xab
 )
 
 type MoqRole uint
@@ -79,6 +92,7 @@ const (
 	MoqIdMessageAnnounceOk    MoqMessageType = 0x7
 	MoqIdMessageAnnounceError MoqMessageType = 0x8
 	MoqIdMessageUnAnnounce    MoqMessageType = 0x9
+	MoqIdUnsubscribe          MoqMessageType = 0xa
 
 	InternalId MoqMessageType = 0xffff
 )
@@ -89,6 +103,7 @@ const (
 type MoqMessageSetup struct {
 	SupportedClientVersions []MoqVersion
 	Role                    MoqRole
+	AuthInfo                string
 }
 
 type MoqMessageSetupResponse struct {
@@ -105,6 +120,7 @@ const (
 	ErrorGeneric           MoqErrorCode = 0x1
 	ErrorUnauthorized      MoqErrorCode = 0x2
 	ErrorProtocolViolation MoqErrorCode = 0x3
+	ErrorQuotaExceeded     MoqErrorCode = 0x4
 	ErrorGoAwayTimeout     MoqErrorCode = 0x10
 )
 
@@ -127,9 +143,12 @@ type MoqMessageAnnounceOk struct {
 type MoqErrorCodeAnnounce uint64
 
 const (
-	NoErrorAnnounce          MoqErrorCodeAnnounce = 0x0
-	ErrorAnnounceGeneric     MoqErrorCodeAnnounce = 0x1
-	ErrorAnnounceAddingTrack MoqErrorCodeAnnounce = 0x2
+	NoErrorAnnounce            MoqErrorCodeAnnounce = 0x0
+	ErrorAnnounceGeneric       MoqErrorCodeAnnounce = 0x1
+	ErrorAnnounceAddingTrack   MoqErrorCodeAnnounce = 0x2
+	ErrorAnnounceUnauthorized  MoqErrorCodeAnnounce = 0x3
+	ErrorAnnounceForbidden     MoqErrorCodeAnnounce = 0x4
+	ErrorAnnounceQuotaExceeded MoqErrorCodeAnnounce = 0x5
 )
 
 type MoqMessageAnnounceError struct {
@@ -148,6 +167,7 @@ type MoqMessageSubscribe struct {
 	EndGroup       MoqLocation
 	EndObject      MoqLocation
 	AuthInfo       string
+	AbrPolicy      string
 }
 
 type MoqMessageSubscribeOk struct {
@@ -160,10 +180,14 @@ type MoqMessageSubscribeOk struct {
 type MoqErrorCodeSubscribe uint64
 
 const (
-	NoErrorSubscribe           MoqErrorCodeSubscribe = 0x0
-	ErrorSubscribeGeneric      MoqErrorCodeSubscribe = 0x1
-	ErrorSubscribeAddingTrack  MoqErrorCodeSubscribe = 0x2
-	ErrorSubscribeNoPublishers MoqErrorCodeSubscribe = 0x3
+	NoErrorSubscribe            MoqErrorCodeSubscribe = 0x0
+	ErrorSubscribeGeneric       MoqErrorCodeSubscribe = 0x1
+	ErrorSubscribeAddingTrack   MoqErrorCodeSubscribe = 0x2
+	ErrorSubscribeNoPublishers  MoqErrorCodeSubscribe = 0x3
+	ErrorSubscribeExpired       MoqErrorCodeSubscribe = 0x4
+	ErrorSubscribeUnauthorized  MoqErrorCodeSubscribe = 0x5
+	ErrorSubscribeForbidden     MoqErrorCodeSubscribe = 0x6
+	ErrorSubscribeQuotaExceeded MoqErrorCodeSubscribe = 0x7
 )
 
 type MoqMessageSubscribeError struct {
@@ -173,6 +197,13 @@ type MoqMessageSubscribeError struct {
 	ErrMsg         string
 }
 
+// Unsubscribe
+
+type MoqMessageUnsubscribe struct {
+	TrackNamespace string
+	TrackName      string
+}
+
 func CreateAnnounceOK(moqAnnounce MoqMessageAnnounce) (moqAnnounceOk MoqMessageAnnounceOk) {
 	moqAnnounceOk.TrackNamespace = moqAnnounce.TrackNamespace
 
@@ -217,6 +248,8 @@ func ReceiveMessage(stream quichelpers.IWtReadableStream) (moqMessage interface{
 		moqMessage, err = receiveSubscribe(stream)
 	} else if msgType == uint64(MoqIdSubscribeOk) {
 		moqMessage, err = receiveSubscribeOk(stream)
+	} else if msgType == uint64(MoqIdUnsubscribe) {
+		moqMessage, err = receiveUnsubscribe(stream)
 	} else {
 		err = errors.New(fmt.Sprintf("MOQ not supported message type %d", msgType))
 	}
@@ -343,6 +376,30 @@ func receiveSubscribe(stream quichelpers.IWtReadableStream) (moqSubscribe MoqMes
 	if found {
 		moqSubscribe.AuthInfo = foundObj.(string)
 	}
+	foundObj, found = params[uint64(MoqParamsAbrPolicy)]
+	if found {
+		moqSubscribe.AbrPolicy = foundObj.(string)
+	}
+
+	return
+}
+
+func receiveUnsubscribe(stream quichelpers.IWtReadableStream) (moqUnsubscribe MoqMessageUnsubscribe, err error) {
+	// rx UNSUBSCRIBE
+
+	trackNamespace, errTrackNamespace := quichelpers.ReadString(stream, MOQ_MAX_STRING_LENGTH)
+	if errTrackNamespace != nil {
+		err = errors.New(fmt.Sprintf("MOQ UNSUBSCRIBE reading TrackNamespace, err: %v", errTrackNamespace))
+		return
+	}
+	moqUnsubscribe.TrackNamespace = trackNamespace
+
+	trackName, errTrackName := quichelpers.ReadString(stream, MOQ_MAX_STRING_LENGTH)
+	if errTrackName != nil {
+		err = errors.New(fmt.Sprintf("MOQ UNSUBSCRIBE reading TrackName, err: %v", errTrackName))
+		return
+	}
+	moqUnsubscribe.TrackName = trackName
 
 	return
 }
@@ -399,6 +456,10 @@ func receiveSetUp(stream quichelpers.IWtReadableStream) (moqSetup MoqMessageSetu
 	if found {
 		moqSetup.Role = MoqRole(foundObj.(uint64))
 	}
+	foundObj, found = params[uint64(MoqParamsAuthorizationInfo)]
+	if found {
+		moqSetup.AuthInfo = foundObj.(string)
+	}
 
 	return
 }
@@ -441,29 +502,95 @@ var (
 	VideoCounter int
 )
 
-func ReadObjPayloadToEOS(stream quichelpers.IWtReadableStream, moqObjs map[uint64]*moqobject.MoqObject) error {
+// Reads the object payload appending it as it arrives to the renditions that are forwarded as is
+// (cut-through), renditions of the ladder that need a transformation are generated by encoder when the payload is complete.
+// Also returns the LOC media type of the object. onHeader is called once the LOC header is decoded (key chunk
+// already marked), before the payload is read
+func ReadObjPayloadToEOS(stream quichelpers.IWtReadableStream, moqObjs map[uint64]*moqobject.MoqObject, ladder awt.EncoderLadder, encoder moqencoder.Encoder, onHeader func()) (received int, mediaType string, err error) {
 	// rx Obj payload
 	var (
-		err error
-		wg  sync.WaitGroup
-		loc awt.LocPackager = awt.NewLocPackager()
+		wg          sync.WaitGroup
+		loc         awt.LocPackager = awt.NewLocPackager()
+		header      []byte
+		streamed    []*moqobject.MoqObject
+		transformed []awt.EncoderQuality
 	)
 
-	if err = loc.Decode(stream); err != nil {
-		return err
+	defer func() {
+		if err != nil {
+			for _, moqObj := range moqObjs {
+				moqObj.SetError(err)
+			}
+		}
+	}()
+
+	counter := &countingReader{reader: stream}
+	if err = loc.DecodeHeader(counter); err != nil {
+		if err == io.EOF {
+			// Stream finished before the header
+			err = io.ErrUnexpectedEOF
+		}
+		return counter.n, "", err
+	}
+	received = counter.n
+	mediaType = loc.MediaType
+	if loc.ChunkType == "key" {
+		for _, moqObj := range moqObjs {
+			moqObj.SetKeyChunk()
+		}
+	}
+	onHeader()
+	if header, err = loc.EncodeHeader(); err != nil {
+		return
 	}
 
-	if loc.MediaType == "video" {
+	for _, quality := range ladder {
+		if awt.NeedsEncode(loc.MediaType, quality) {
+			transformed = append(transformed, quality)
+		} else {
+			moqObjs[quality.Bitrate].PayloadWrite(header)
+			streamed = append(streamed, moqObjs[quality.Bitrate])
+		}
+	}
+
+	dataBlockPtr := readBlockPool.Get().(*[]byte)
+	defer readBlockPool.Put(dataBlockPtr)
+	dataBlock := *dataBlockPtr
+	for {
+		readBytes, errRead := stream.Read(dataBlock)
+		received += readBytes
+		if readBytes > 0 {
+			for _, moqObj := range streamed {
+				moqObj.PayloadWrite(dataBlock[:readBytes])
+			}
+			if len(transformed) > 0 {
+				// Only kept if some rendition needs it
+				loc.Data = append(loc.Data, dataBlock[:readBytes]...)
+			}
+		}
+		if errRead == io.EOF {
+			break
+		}
+		if errRead != nil {
+			return received, mediaType, errRead
+		}
+	}
+	for _, moqObj := range streamed {
+		moqObj.SetEof()
+	}
+
+	if loc.MediaType == "video" && len(transformed) > 0 {
 		if VideoCounter > 9 && VideoCounter < 20 {
 			os.WriteFile(fmt.Sprintf("../../data/%s-%d.mp4", loc.MediaType, VideoCounter), loc.Data, os.ModePerm)
 		}
 		VideoCounter++
 	}
 
-	// encode all qualities concurrently
-	for _, quality := range awt.EncoderSettings {
+	// encode the transformed qualities concurrently
+	errs := make([]error, len(transformed))
+	for i, quality := range transformed {
 		wg.Add(1)
-		go func(q awt.EncoderQuality) {
+		go func(i int, q awt.EncoderQuality) {
 			defer wg.Done()
 
 			var (
@@ -471,27 +598,47 @@ func ReadObjPayloadToEOS(stream quichelpers.IWtReadableStream, moqObjs map[uint6
 				newLocs awt.LocPackager = loc.Copy()
 			)
 
-			if newLocs.Data, err = awt.Encode(loc.Data, q); err != nil {
+			if newLocs.Data, errs[i] = encoder.Encode(loc.Data, q); errs[i] != nil {
+				errs[i] = errors.New(fmt.Sprintf("Encoding rendition %d with %s, err: %v", q.Bitrate, encoder.Name(), errs[i]))
 				return
 			}
 
-			if buf, err = newLocs.Encode(); err != nil {
+			if buf, errs[i] = newLocs.Encode(); errs[i] != nil {
 				return
 			}
 
 			moqObjs[q.Bitrate].PayloadWrite(buf)
-		}(quality)
+			moqObjs[q.Bitrate].SetEof()
+		}(i, quality)
 	}
 
 	wg.Wait()
 
-	if err == io.EOF {
-		for _, quality := range awt.EncoderSettings {
-			moqObjs[quality.Bitrate].SetEof()
-		}
-		return nil
+	return received, mediaType, errors.Join(errs...)
+}
+
+// Reads an opaque object payload (never decoded), bytes are appended as they arrive
+func ReadOpaquePayloadToEOS(stream quichelpers.IWtReadableStream, moqObj *moqobject.MoqObject) (received int, err error) {
+	n, err := moqObj.ReadFrom(stream)
+	if err != nil {
+		moqObj.SetError(err)
+		return int(n), err
 	}
-	return err
+	moqObj.SetEof()
+
+	return int(n), nil
+}
+
+// Counts bytes read
+type countingReader struct {
+	reader quichelpers.IWtReadableStream
+	n      int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += n
+	return n, err
 }
 
 func SendServerSetup(stream quichelpers.IWtWritableStream, moqSetupResponse MoqMessageSetupResponse) error {
@@ -700,13 +847,14 @@ func SendSubscribeError(stream quichelpers.IWtWritableStream, moqSubscribeError
 	return nil
 }
 
-func SendObject(stream quichelpers.IWtWritableStream, moqObj *moqobject.MoqObject) error {
+// Sends the object while it is being received (cut-through) with the subscription trackId, ctx ends the wait for new bytes
+func SendObject(ctx context.Context, stream quichelpers.IWtWritableStream, trackId uint64, moqObj *moqobject.MoqObject) error {
 
 	err := quichelpers.WriteVarint(stream, uint64(MoqIdMessageObject))
 	if err != nil {
 		return err
 	}
-	err = quichelpers.WriteVarint(stream, moqObj.TrackId)
+	err = quichelpers.WriteVarint(stream, trackId)
 	if err != nil {
 		return err
 	}
@@ -723,19 +871,10 @@ func SendObject(stream quichelpers.IWtWritableStream, moqObj *moqobject.MoqObjec
 		return err
 	}
 
-	dataBlock := make([]byte, READ_BLOCK_SIZE_BYTES)
-	srcReader := moqObj.NewReader()
-	readBytes := 0
-	totalSent := 0
-	var errRead error = nil
-	for errRead == nil {
-		readBytes, errRead = srcReader.Read(dataBlock)
-		if readBytes > 0 {
-			stream.Write(dataBlock[:readBytes])
-			totalSent += readBytes
-		}
-	}
-	return nil
+	srcReader := moqObj.NewReader(ctx)
+	defer srcReader.Close()
+	_, err = io.Copy(stream, srcReader)
+	return err
 }
 
 // Helpers
@@ -765,6 +904,14 @@ func readParameters(stream quichelpers.IWtReadableStream) (parameters map[uint64
 			}
 			parameters[paramId] = authInfo
 
+		} else if MoqParams(paramId) == MoqParamsAbrPolicy {
+			abrPolicy, errAbrPolicy := quichelpers.ReadString(stream, MOQ_MAX_STRING_LENGTH)
+			if errAbrPolicy != nil {
+				err = errors.New(fmt.Sprintf("MOQ parameters reading ABR policy, err: %v", errAbrPolicy))
+				return
+			}
+			parameters[paramId] = abrPolicy
+
 		} else if MoqParams(paramId) == MoqParamsRole {
 			_, errLength := quichelpers.ReadVarint(stream)
 			if errLength != nil {
@@ -9,6 +9,8 @@ package quichelpers
 import (
 	"errors"
 	"fmt"
+	"io"
+	"sync"
 )
 
 type IWtReadableStream interface {
@@ -27,26 +29,36 @@ const (
 	maxVarInt8 = 4611686018427387903
 )
 
+// Reused var int buffers (a var int is at most 8 bytes)
+var varintPool = sync.Pool{
+	New: func() any {
+		return new([8]byte)
+	},
+}
+
 func ReadBytes(stream IWtReadableStream, buffer []byte) error {
 	readSize := 0
 	totalSize := len(buffer)
 	var err error = nil
 	for readSize < totalSize && err == nil {
 		n := 0
-		tmpBuffer := make([]byte, totalSize-readSize)
-		n, err = stream.Read(tmpBuffer)
-		copy(buffer[readSize:readSize+n], tmpBuffer[0:n])
-
+		n, err = stream.Read(buffer[readSize:])
 		readSize += n
 	}
+	if readSize >= totalSize && err == io.EOF {
+		// All requested bytes are here, EOF will be returned on the next read
+		err = nil
+	}
 	return err
 }
 
 func ReadByte(stream IWtReadableStream) (ret byte, err error) {
-	tmpBuffer := []byte{0}
-	err = ReadBytes(stream, tmpBuffer)
+	buf := varintPool.Get().(*[8]byte)
+	defer varintPool.Put(buf)
+
+	err = ReadBytes(stream, buf[:1])
 	if err == nil {
-		ret = tmpBuffer[0]
+		ret = buf[0]
 	}
 	return
 }
@@ -54,58 +66,31 @@ func ReadByte(stream IWtReadableStream) (ret byte, err error) {
 // Var int helpers
 
 func ReadVarint(stream IWtReadableStream) (uint64, error) {
-	firstByte, err := ReadByte(stream)
-	if err != nil {
+	buf := varintPool.Get().(*[8]byte)
+	defer varintPool.Put(buf)
+
+	if err := ReadBytes(stream, buf[:1]); err != nil {
 		return 0, err
 	}
 	// the first two bits of the first byte encode the length
-	len := 1 << ((firstByte & 0xc0) >> 6)
-	b1 := firstByte & (0xff - 0xc0)
-	if len == 1 {
-		return uint64(b1), nil
-	}
-	b2, err := ReadByte(stream)
-	if err != nil {
-		return 0, err
-	}
-	if len == 2 {
-		return uint64(b2) + uint64(b1)<<8, nil
-	}
-	b3, err := ReadByte(stream)
-	if err != nil {
-		return 0, err
-	}
-	b4, err := ReadByte(stream)
-	if err != nil {
-		return 0, err
-	}
-	if len == 4 {
-		return uint64(b4) + uint64(b3)<<8 + uint64(b2)<<16 + uint64(b1)<<24, nil
-	}
-	b5, err := ReadByte(stream)
-	if err != nil {
-		return 0, err
-	}
-	b6, err := ReadByte(stream)
-	if err != nil {
-		return 0, err
-	}
-	b7, err := ReadByte(stream)
-	if err != nil {
-		return 0, err
+	len := 1 << ((buf[0] & 0xc0) >> 6)
+	if len > 1 {
+		if err := ReadBytes(stream, buf[1:len]); err != nil {
+			return 0, err
+		}
 	}
-	b8, err := ReadByte(stream)
-	if err != nil {
-		return 0, err
+	ret := uint64(buf[0] & (0xff - 0xc0))
+	for i := 1; i < len; i++ {
+		ret = ret<<8 + uint64(buf[i])
 	}
-	return uint64(b8) + uint64(b7)<<8 + uint64(b6)<<16 + uint64(b5)<<24 + uint64(b4)<<32 + uint64(b3)<<40 + uint64(b2)<<48 + uint64(b1)<<56, nil
+	return ret, nil
 }
 
 func writeSafe(stream IWtWritableStream, data []byte) error {
 	remainingBytes := len(data)
 	start := 0
 	for remainingBytes > 0 {
-		n, err := stream.Write(data[start:remainingBytes])
+		n, err := stream.Write(data[start:])
 		if err != nil {
 			return err
 		}
@@ -131,21 +116,28 @@ func VarIntLength(i uint64) (size uint, err error) {
 }
 
 func WriteVarint(stream IWtWritableStream, i uint64) error {
-	if i <= maxVarInt1 {
-		return writeSafe(stream, []byte{uint8(i)})
-	}
-	if i <= maxVarInt2 {
-		return writeSafe(stream, []byte{uint8(i>>8) | 0x40, uint8(i)})
-	}
-	if i <= maxVarInt4 {
-		return writeSafe(stream, []byte{uint8(i>>24) | 0x80, uint8(i >> 16), uint8(i >> 8), uint8(i)})
+	size, err := VarIntLength(i)
+	if err != nil {
+		return err
 	}
-	if i <= maxVarInt8 {
-		return writeSafe(stream, []byte{uint8(i>>56) | 0xc0, uint8(i >> 48), uint8(i >> 40), uint8(i >> 32),
-			uint8(i >> 24), uint8(i >> 16), uint8(i >> 8), uint8(i),
-		})
+
+	buf := varintPool.Get().(*[8]byte)
+	defer varintPool.Put(buf)
+
+	for pos := int(size) - 1; pos >= 0; pos-- {
+		buf[pos] = uint8(i)
+		i >>= 8
 	}
-	return errors.New(fmt.Sprintf("%#x doesn't fit into 62 bits", i))
+	// the first two bits of the first byte encode the length
+	switch size {
+	case 2:
+		buf[0] |= 0x40
+	case 4:
+		buf[0] |= 0x80
+	case 8:
+		buf[0] |= 0xc0
+	}
+	return writeSafe(stream, buf[:size])
 }
 
 // MOQT String
@@ -0,0 +1,66 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package quichelpers
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// Run: go test -run=^$ -bench=. -benchmem ./moqhelpers/quichelpers
+
+// Reader that repeats its content forever
+type loopReader struct {
+	data   []byte
+	offset int
+}
+
+func (r *loopReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.offset:])
+	r.offset = (r.offset + n) % len(r.data)
+	return n, nil
+}
+
+func BenchmarkWriteVarint(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := WriteVarint(io.Discard, uint64(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadVarint(b *testing.B) {
+	var buf bytes.Buffer
+	for _, v := range []uint64{42, 16000, 1 << 29, 1 << 50} {
+		WriteVarint(&buf, v)
+	}
+	stream := &loopReader{data: buf.Bytes()}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ReadVarint(stream); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadBytes(b *testing.B) {
+	stream := &loopReader{data: make([]byte, 4096)}
+	buffer := make([]byte, 1200)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buffer)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ReadBytes(stream, buffer); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqmessageobjects
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"facebookexperimental/moq-go-server/moqobject"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/maps"
+)
+
+const DISK_TIER_SPILL_QUEUE_SIZE = 1024
+
+// Object stored in the disk tier (all its renditions)
+type diskEntry struct {
+	cacheKey moqobject.CacheKey
+	header   moqobject.MoqObjectHeader
+
+	receivedAt time.Time
+	maxAgeS    uint64
+
+	// Set while the spill is pending, objects are served from memory meanwhile
+	pendingObjs map[uint64]*moqobject.MoqObject
+
+	// map[bitrate]size (bytes) of files written
+	files map[uint64]uint64
+
+	// Bytes on disk
+	size uint64
+
+	lruElem *list.Element
+
+	// Expiration and position in the expiry index
+	expiryPosition
+}
+
+// Second tier for completed (EOF) objects, only the index is kept in memory
+type diskTier struct {
+	dir string
+
+	// Limits (0 = no limit)
+	maxBytes uint64
+	maxAgeMs uint64
+
+	// map[cacheKey]diskEntry
+	index map[moqobject.CacheKey]*diskEntry
+
+	// LRU order, front is the most recently used
+	lru *list.List
+
+	// Only used with maxAgeMs
+	expiry expiryIndex[*diskEntry]
+
+	// Bytes on disk
+	bytes uint64
+
+	// Lock used to protect the index
+	lock *sync.Mutex
+
+	spillChannel chan *diskEntry
+	stopChannel  chan bool
+}
+
+// Enables the disk tier in dir, maxBytes and maxAgeMs are its own limits (0 = no limit)
+func (moqtObjs *MoqMessageObjects) EnableDiskTier(dir string, maxBytes uint64, maxAgeMs uint64) (err error) {
+	// Previous content has no index, so it is useless
+	if err = os.RemoveAll(dir); err != nil {
+		return
+	}
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return
+	}
+
+	disk := diskTier{dir: dir, maxBytes: maxBytes, maxAgeMs: maxAgeMs, index: map[moqobject.CacheKey]*diskEntry{}, lru: list.New(), lock: new(sync.Mutex), spillChannel: make(chan *diskEntry, DISK_TIER_SPILL_QUEUE_SIZE), stopChannel: make(chan bool)}
+	go disk.runSpills()
+
+	moqtObjs.disk = &disk
+
+	log.Info(fmt.Sprintf("Enabled disk tier at %s, max bytes: %d, max age ms: %d", dir, maxBytes, maxAgeMs))
+
+	return
+}
+
+func (disk *diskTier) spill(cacheKey moqobject.CacheKey, objs map[uint64]*moqobject.MoqObject) {
+	var (
+		anyObj *moqobject.MoqObject
+	)
+
+	for _, obj := range objs {
+		if !obj.GetEof() {
+			// Only completed objects
+			return
+		}
+		anyObj = obj
+	}
+	if anyObj == nil {
+		return
+	}
+
+	entry := &diskEntry{cacheKey: cacheKey, header: anyObj.MoqObjectHeader, receivedAt: anyObj.ReceivedAt, maxAgeS: anyObj.MaxAgeS, pendingObjs: objs, files: map[uint64]uint64{}, expiryPosition: newExpiryPosition()}
+	if disk.isExpired(entry, time.Now()) {
+		return
+	}
+
+	disk.lock.Lock()
+	if _, found := disk.index[cacheKey]; found {
+		disk.lock.Unlock()
+		return
+	}
+	// Keep the payload until it is written
+	for _, obj := range objs {
+		obj.Retain()
+	}
+	entry.lruElem = disk.lru.PushFront(entry)
+	disk.index[cacheKey] = entry
+	if disk.maxAgeMs > 0 {
+		disk.expiry.add(entry, entry.receivedAt.Add(time.Millisecond*time.Duration(disk.maxAgeMs)))
+	}
+	disk.lock.Unlock()
+
+	select {
+	case disk.spillChannel <- entry:
+	default:
+		log.Warn(fmt.Sprintf("Disk tier spill queue full, dropping: %s", cacheKey))
+		disk.lock.Lock()
+		disk.deleteLocked(entry)
+		disk.lock.Unlock()
+		releaseAll(objs)
+	}
+}
+
+func releaseAll(objs map[uint64]*moqobject.MoqObject) {
+	for _, obj := range objs {
+		obj.Release()
+	}
+}
+
+func (disk *diskTier) get(cacheKey moqobject.CacheKey, etp uint64) (moqObjRet *moqobject.MoqObject, found bool) {
+	var (
+		entry   *diskEntry
+		bitrate uint64
+		file    *os.File
+		err     error
+	)
+
+	disk.lock.Lock()
+	if entry, found = disk.index[cacheKey]; !found {
+		disk.lock.Unlock()
+		return
+	}
+	disk.lru.MoveToFront(entry.lruElem)
+	if entry.pendingObjs != nil {
+		moqObjRet = entry.pendingObjs[bestFitBitrate(maps.Keys(entry.pendingObjs), etp)]
+		moqObjRet.Retain()
+		disk.lock.Unlock()
+		return
+	}
+	bitrate = bestFitBitrate(maps.Keys(entry.files), etp)
+	disk.lock.Unlock()
+
+	if file, err = os.Open(disk.filePath(cacheKey, bitrate)); err == nil {
+		// Transient object, NOT added back to memory (the caller owns the only reference)
+		moqObjRet = moqobject.New(entry.header, entry.maxAgeS)
+		moqObjRet.ReceivedAt = entry.receivedAt
+		_, err = moqObjRet.ReadFrom(file)
+		file.Close()
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("Disk tier reading %s (%d). Err: %v", cacheKey, bitrate, err))
+		if moqObjRet != nil {
+			moqObjRet.Release()
+		}
+		return nil, false
+	}
+	moqObjRet.SetEof()
+
+	return
+}
+
+func (disk *diskTier) filePath(cacheKey moqobject.CacheKey, bitrate uint64) string {
+	return objectFilePath(disk.dir, cacheKey, bitrate)
+}
+
+// Names are hashed, namespaces and names can contain any character
+func objectFilePath(dir string, cacheKey moqobject.CacheKey, bitrate uint64) string {
+	hash := sha1.Sum([]byte(cacheKey.Id()))
+	return filepath.Join(dir, fmt.Sprintf("%s-%d.obj", hex.EncodeToString(hash[:]), bitrate))
+}
+
+func (disk *diskTier) isExpired(entry *diskEntry, now time.Time) bool {
+	return disk.maxAgeMs > 0 && entry.receivedAt.Add(time.Millisecond*time.Duration(disk.maxAgeMs)).Before(now)
+}
+
+func (disk *diskTier) runSpills() {
+	exit := false
+	for !exit {
+		select {
+		case entry := <-disk.spillChannel:
+			disk.write(entry)
+
+		case <-disk.stopChannel:
+			exit = true
+		}
+	}
+	// Indicates finished
+	disk.stopChannel <- true
+}
+
+func (disk *diskTier) write(entry *diskEntry) {
+	defer releaseAll(entry.pendingObjs)
+
+	files := map[uint64]uint64{}
+	size := uint64(0)
+
+	for bitrate, obj := range entry.pendingObjs {
+		written, err := writeObjectFile(disk.filePath(entry.cacheKey, bitrate), obj)
+		if err != nil {
+			log.Error(fmt.Sprintf("Disk tier writing %s (%d). Err: %v", entry.cacheKey, bitrate, err))
+			disk.lock.Lock()
+			disk.deleteLocked(entry)
+			// NOT in the entry yet, also the partial one
+			os.Remove(disk.filePath(entry.cacheKey, bitrate))
+			for writtenBitrate := range files {
+				os.Remove(disk.filePath(entry.cacheKey, writtenBitrate))
+			}
+			disk.lock.Unlock()
+			return
+		}
+		files[bitrate] = uint64(written)
+		size += uint64(written)
+	}
+
+	disk.lock.Lock()
+	defer disk.lock.Unlock()
+
+	if disk.index[entry.cacheKey] != entry {
+		// Deleted while writing
+		for bitrate := range files {
+			os.Remove(disk.filePath(entry.cacheKey, bitrate))
+		}
+		return
+	}
+	entry.files = files
+	entry.size = size
+	entry.pendingObjs = nil
+	disk.bytes += size
+
+	// Evict least recently used over budget
+	elem := disk.lru.Back()
+	for elem != nil && disk.maxBytes > 0 && disk.bytes > disk.maxBytes {
+		prev := elem.Prev()
+		evictEntry := elem.Value.(*diskEntry)
+		if evictEntry.pendingObjs == nil {
+			disk.deleteLocked(evictEntry)
+			log.Info(fmt.Sprintf("EVICTED disk tier object over budget: %s (%d bytes)", evictEntry.cacheKey, evictEntry.size))
+		}
+		elem = prev
+	}
+}
+
+// Writes the payload straight from the object chunks
+func writeObjectFile(path string, obj *moqobject.MoqObject) (written int64, err error) {
+	var (
+		file *os.File
+	)
+
+	if file, err = os.Create(path); err != nil {
+		return
+	}
+	reader := obj.NewReader(context.Background())
+	written, err = io.Copy(file, reader)
+	reader.Close()
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	return
+}
+
+func (disk *diskTier) deleteLocked(entry *diskEntry) {
+	if disk.index[entry.cacheKey] != entry {
+		// Already deleted, the key can belong to a newer entry
+		return
+	}
+	delete(disk.index, entry.cacheKey)
+	disk.lru.Remove(entry.lruElem)
+	disk.expiry.remove(entry)
+	disk.bytes -= entry.size
+
+	for bitrate := range entry.files {
+		os.Remove(disk.filePath(entry.cacheKey, bitrate))
+	}
+}
+
+// Removes expired objects in small batches, so spills and reads are only blocked for one batch
+func (disk *diskTier) cleanUp(now time.Time) {
+	numDeleted := 0
+	for {
+		numBatchDeleted, pending := disk.cleanUpBatch(now)
+		numDeleted += numBatchDeleted
+		if !pending {
+			break
+		}
+	}
+
+	if numDeleted > 0 {
+		disk.lock.Lock()
+		log.Info(fmt.Sprintf("Finished cleanup disk tier round expired. Deleted: %d, elements: %d, bytes held: %d", numDeleted, len(disk.index), disk.bytes))
+		disk.lock.Unlock()
+	}
+}
+
+func (disk *diskTier) cleanUpBatch(now time.Time) (numDeleted int, pending bool) {
+	disk.lock.Lock()
+	defer disk.lock.Unlock()
+
+	for i := 0; i < EXPIRY_BATCH_SIZE; i++ {
+		entry, found := disk.expiry.popExpired(now)
+		if !found {
+			return
+		}
+		if entry.pendingObjs != nil {
+			// Still being written, try again later
+			disk.expiry.add(entry, now.Add(time.Millisecond*EXPIRY_IN_USE_RETRY_MS))
+			continue
+		}
+		disk.deleteLocked(entry)
+		numDeleted++
+	}
+	return numDeleted, true
+}
+
+func (disk *diskTier) stop() {
+	// Send finish signal
+	disk.stopChannel <- true
+
+	// Wait to finish
+	<-disk.stopChannel
+}
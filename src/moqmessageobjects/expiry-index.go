@@ -0,0 +1,92 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqmessageobjects
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Expiration, and position in an expiry index (-1 = not indexed)
+type expiryPosition struct {
+	expiresAt time.Time
+	heapIndex int
+}
+
+func newExpiryPosition() expiryPosition {
+	return expiryPosition{heapIndex: -1}
+}
+
+func (p *expiryPosition) position() *expiryPosition {
+	return p
+}
+
+// Entries that can be indexed, by embedding expiryPosition
+type expiryItem interface {
+	position() *expiryPosition
+}
+
+// Min-heap of entries keyed by expiration time
+type expiryIndex[T expiryItem] []T
+
+func (ei expiryIndex[T]) Len() int {
+	return len(ei)
+}
+
+func (ei expiryIndex[T]) Less(i, j int) bool {
+	return ei[i].position().expiresAt.Before(ei[j].position().expiresAt)
+}
+
+func (ei expiryIndex[T]) Swap(i, j int) {
+	ei[i], ei[j] = ei[j], ei[i]
+	ei[i].position().heapIndex = i
+	ei[j].position().heapIndex = j
+}
+
+func (ei *expiryIndex[T]) Push(x any) {
+	entry := x.(T)
+	entry.position().heapIndex = len(*ei)
+	*ei = append(*ei, entry)
+}
+
+func (ei *expiryIndex[T]) Pop() any {
+	var zero T
+	old := *ei
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = zero
+	entry.position().heapIndex = -1
+	*ei = old[:n-1]
+	return entry
+}
+
+func (ei *expiryIndex[T]) add(entry T, expiresAt time.Time) {
+	entry.position().expiresAt = expiresAt
+	heap.Push(ei, entry)
+}
+
+func (ei *expiryIndex[T]) remove(entry T) {
+	if entry.position().heapIndex >= 0 {
+		heap.Remove(ei, entry.position().heapIndex)
+	}
+}
+
+// Returns the first entry if it is expired at now
+func (ei *expiryIndex[T]) popExpired(now time.Time) (entry T, found bool) {
+	if ei.Len() <= 0 || (*ei)[0].position().expiresAt.After(now) {
+		return
+	}
+	return heap.Pop(ei).(T), true
+}
+
+// Time of the next expiration (zero if empty)
+func (ei expiryIndex[T]) next() time.Time {
+	if ei.Len() <= 0 {
+		return time.Time{}
+	}
+	return ei[0].position().expiresAt
+}
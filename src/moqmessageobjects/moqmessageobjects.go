@@ -7,33 +7,102 @@ LICENSE file in the root directory of this source tree.
 package moqmessageobjects
 
 import (
+	"container/list"
 	"errors"
-	"facebookexperimental/moq-go-server/awt"
 	"facebookexperimental/moq-go-server/moqobject"
 	"fmt"
+	"hash/fnv"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/exp/maps"
 )
 
+// Number of cache shards, objects of the same track are always in the same shard
+const CACHE_NUM_SHARDS = 64
+
+// Rendition (bitrate) of the single copy kept for opaque tracks
+const OPAQUE_BITRATE = 0
+
+// Max expired objects deleted per lock acquisition
+const EXPIRY_BATCH_SIZE = 64
+
+// Min wait between expiration rounds
+const EXPIRY_MIN_WAIT_MS = 100
+
+// Delay to retry expiration of objects in use
+const EXPIRY_IN_USE_RETRY_MS = 1000
+
+// Cached object (all its renditions)
+type cacheEntry struct {
+	cacheKey moqobject.CacheKey
+
+	// map[bitrate]MoqObject
+	objs map[uint64]*moqobject.MoqObject
+
+	// Payload bytes held by all renditions
+	size uint64
+
+	// Positions in the LRU lists (shard and track)
+	lruElem      *list.Element
+	trackLruElem *list.Element
+
+	// Expiration and position in the expiry index
+	expiryPosition
+}
+
+// Subset of tracks of the cache, with its own lock
+type cacheShard struct {
+	// map[cacheKey]cacheEntry
+	dataMap map[moqobject.CacheKey]*cacheEntry
+
+	// LRU order, front is the most recently used
+	lru *list.List
+
+	// Per track LRU, accounting and ordered index
+	tracks map[moqobject.TrackKey]*cacheTrack
+
+	// Entries by expiration time
+	expiry expiryIndex[*cacheEntry]
+
+	// Lock used to write / read the shard
+	lock *sync.RWMutex
+}
+
 // File Definition of files
 type MoqMessageObjects struct {
-	// map[cacheKey]map[bitrate]MoqObject
-	dataMap map[string]map[uint64]*moqobject.MoqObject
+	shards []*cacheShard
 
-	// FilesLock Lock used to write / read files
-	mapLock *sync.RWMutex
+	// Accounting (bytes held by all shards)
+	bytes atomic.Uint64
+
+	// Over budget with every remaining object in use was logged (until back under budget)
+	overBudgetLogged atomic.Bool
+
+	// Limits (0 = no limit)
+	maxBytes      uint64
+	maxTrackBytes uint64
+
+	// Optional second tier for completed objects (nil = disabled)
+	disk *diskTier
 
 	// Housekeeping thread channel
 	cleanUpChannel chan bool
 }
 
-// New Creates a new mem files map
-func New(housekeepingPeriodMs uint64) *MoqMessageObjects {
-	moqtObjs := MoqMessageObjects{dataMap: map[string]map[uint64]*moqobject.MoqObject{}, mapLock: new(sync.RWMutex), cleanUpChannel: make(chan bool)}
+// New Creates a new mem files map, maxBytes and maxTrackBytes are the byte budgets (0 = no limit)
+func New(housekeepingPeriodMs uint64, maxBytes uint64, maxTrackBytes uint64) *MoqMessageObjects {
+	return newWithShards(CACHE_NUM_SHARDS, housekeepingPeriodMs, maxBytes, maxTrackBytes)
+}
+
+func newWithShards(numShards int, housekeepingPeriodMs uint64, maxBytes uint64, maxTrackBytes uint64) *MoqMessageObjects {
+	moqtObjs := MoqMessageObjects{maxBytes: maxBytes, maxTrackBytes: maxTrackBytes, cleanUpChannel: make(chan bool)}
+	for i := 0; i < numShards; i++ {
+		moqtObjs.shards = append(moqtObjs.shards, &cacheShard{dataMap: map[moqobject.CacheKey]*cacheEntry{}, lru: list.New(), tracks: map[moqobject.TrackKey]*cacheTrack{}, lock: new(sync.RWMutex)})
+	}
 
 	if housekeepingPeriodMs > 0 {
 		moqtObjs.startCleanUp(housekeepingPeriodMs)
@@ -42,42 +111,86 @@ func New(housekeepingPeriodMs uint64) *MoqMessageObjects {
 	return &moqtObjs
 }
 
-func (moqtObjs *MoqMessageObjects) Create(cacheKey string, objHeader moqobject.MoqObjectHeader, defObjExpirationS uint64) (moqObjs map[uint64]*moqobject.MoqObject, err error) {
-	moqtObjs.mapLock.Lock()
-	defer moqtObjs.mapLock.Unlock()
+func (moqtObjs *MoqMessageObjects) shardFor(trackKey moqobject.TrackKey) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(trackKey.Namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(trackKey.Name))
+	return moqtObjs.shards[h.Sum32()%uint32(len(moqtObjs.shards))]
+}
+
+// Creates one object per rendition bitrate, opaque tracks use a single one (OPAQUE_BITRATE)
+func (moqtObjs *MoqMessageObjects) Create(cacheKey moqobject.CacheKey, objHeader moqobject.MoqObjectHeader, defObjExpirationS uint64, bitrates []uint64) (moqObjs map[uint64]*moqobject.MoqObject, err error) {
+	entry := &cacheEntry{cacheKey: cacheKey, expiryPosition: newExpiryPosition()}
+	shard := moqtObjs.shardFor(cacheKey.TrackKey)
 
-	_, found := moqtObjs.dataMap[cacheKey]
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	_, found := shard.dataMap[cacheKey]
 	if found /* && !foundObj.GetEof() */ {
 		err = errors.New("We can NOT override on open object")
 		return
 	}
 
-	// create a new Object for every Quality (bitrate)
+	// create a new Object for every rendition (bitrate)
 	moqObjs = map[uint64]*moqobject.MoqObject{}
-	for _, quality := range awt.EncoderSettings {
+	for _, bitrate := range bitrates {
 		moqObj := moqobject.New(objHeader, defObjExpirationS)
-		moqObjs[quality.Bitrate] = moqObj
+		moqObj.SetOnWrite(func(n int) {
+			moqtObjs.accountWrite(shard, entry, n)
+		})
+		moqObjs[bitrate] = moqObj
 	}
-	moqtObjs.dataMap[cacheKey] = moqObjs
+	entry.objs = moqObjs
+	shard.insertLocked(entry, time.Now().Add(time.Second*time.Duration(defObjExpirationS)))
 
 	return
 }
 
-// gets the best fitting MoqObject by bitrate
-func (moqtObjs *MoqMessageObjects) get(cacheKey string, etp uint64) (moqObjRet *moqobject.MoqObject, found bool) {
-	moqtObjs.mapLock.RLock()
-	defer moqtObjs.mapLock.RUnlock()
+// Adds the entry to the shard indexes
+func (shard *cacheShard) insertLocked(entry *cacheEntry, expiresAt time.Time) {
+	track, foundTrack := shard.tracks[entry.cacheKey.TrackKey]
+	if !foundTrack {
+		track = newCacheTrack()
+		shard.tracks[entry.cacheKey.TrackKey] = track
+	}
+	track.add(entry.cacheKey)
+	entry.lruElem = shard.lru.PushFront(entry)
+	entry.trackLruElem = track.lru.PushFront(entry)
+	shard.expiry.add(entry, expiresAt)
+	shard.dataMap[entry.cacheKey] = entry
+}
 
+// gets the best fitting MoqObject by bitrate
+func (moqtObjs *MoqMessageObjects) get(cacheKey moqobject.CacheKey, etp uint64) (moqObjRet *moqobject.MoqObject, found bool) {
 	var (
-		bestFitBitrate uint64
-		bitrates       []uint64
-		objs           map[uint64]*moqobject.MoqObject
+		entry *cacheEntry
+		shard *cacheShard = moqtObjs.shardFor(cacheKey.TrackKey)
 	)
 
-	if objs, found = moqtObjs.dataMap[cacheKey]; !found {
+	// Write lock, reads update the LRU order
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	if entry, found = shard.dataMap[cacheKey]; !found {
 		return
 	}
-	bitrates = maps.Keys(objs)
+	shard.lru.MoveToFront(entry.lruElem)
+	shard.tracks[cacheKey.TrackKey].lru.MoveToFront(entry.trackLruElem)
+
+	moqObjRet = entry.objs[bestFitBitrate(maps.Keys(entry.objs), etp)]
+	moqObjRet.Retain()
+
+	return
+}
+
+// best fitting bitrate for etp, the lowest one if none fits
+func bestFitBitrate(bitrates []uint64, etp uint64) uint64 {
+	var (
+		bestFitBitrate uint64
+	)
+
 	slices.Sort(bitrates)
 
 	for _, br := range bitrates {
@@ -91,22 +204,198 @@ func (moqtObjs *MoqMessageObjects) get(cacheKey string, etp uint64) (moqObjRet *
 
 	// no fitting bitrate found, use the lowest
 	if !slices.Contains(bitrates, bestFitBitrate) {
-		return objs[bitrates[0]], true
+		return bitrates[0]
 	}
 
-	moqObjRet = objs[bestFitBitrate]
-
-	return
+	return bestFitBitrate
 }
 
-func (moqtObjs *MoqMessageObjects) Get(cacheKey string, bitrate uint64) (moqObjRet *moqobject.MoqObject, found bool) {
+// Gets the best fitting rendition for bitrate, it needs to be released (Release) when done
+func (moqtObjs *MoqMessageObjects) Get(cacheKey moqobject.CacheKey, bitrate uint64) (moqObjRet *moqobject.MoqObject, found bool) {
 	moqObjRet, found = moqtObjs.get(cacheKey, bitrate)
+	if !found && moqtObjs.disk != nil {
+		// Not in memory anymore, try the disk tier
+		moqObjRet, found = moqtObjs.disk.get(cacheKey, bitrate)
+	}
 
 	return
 }
 
+// The object is a key chunk (see MoqObject.IsKeyChunk), only known for objects in memory
+func (moqtObjs *MoqMessageObjects) IsKeyChunk(cacheKey moqobject.CacheKey) bool {
+	shard := moqtObjs.shardFor(cacheKey.TrackKey)
+
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	entry, found := shard.dataMap[cacheKey]
+	if !found {
+		return false
+	}
+	for _, obj := range entry.objs {
+		return obj.IsKeyChunk()
+	}
+	return false
+}
+
 func (moqtObjs *MoqMessageObjects) Stop() {
 	moqtObjs.stopCleanUp()
+	if moqtObjs.disk != nil {
+		moqtObjs.disk.stop()
+	}
+}
+
+// Bytes held by the cache
+func (moqtObjs *MoqMessageObjects) BytesHeld() uint64 {
+	return moqtObjs.bytes.Load()
+}
+
+// Latest group of a track held in memory
+func (moqtObjs *MoqMessageObjects) LatestGroup(trackKey moqobject.TrackKey) (group uint64, found bool) {
+	shard := moqtObjs.shardFor(trackKey)
+
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	if track, foundTrack := shard.tracks[trackKey]; foundTrack {
+		return track.latestGroup()
+	}
+	return
+}
+
+// Keys of a track held in memory from startGroup to endGroup (both included), in group / object order
+func (moqtObjs *MoqMessageObjects) GroupRange(trackKey moqobject.TrackKey, startGroup uint64, endGroup uint64) []moqobject.CacheKey {
+	shard := moqtObjs.shardFor(trackKey)
+
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	if track, found := shard.tracks[trackKey]; found {
+		return track.keysInRange(trackKey, startGroup, endGroup)
+	}
+	return nil
+}
+
+// Keys of the latest numGroups groups of a track held in memory (ex: to catch up new subscribers)
+func (moqtObjs *MoqMessageObjects) RecentGroups(trackKey moqobject.TrackKey, numGroups uint64) []moqobject.CacheKey {
+	shard := moqtObjs.shardFor(trackKey)
+
+	shard.lock.RLock()
+	track, found := shard.tracks[trackKey]
+	var startGroup, endGroup uint64
+	if found {
+		startGroup, endGroup, found = track.latestGroups(numGroups)
+	}
+	shard.lock.RUnlock()
+
+	if !found {
+		return nil
+	}
+	return moqtObjs.GroupRange(trackKey, startGroup, endGroup)
+}
+
+// Budget
+
+func (moqtObjs *MoqMessageObjects) accountWrite(shard *cacheShard, entry *cacheEntry, n int) {
+	shard.lock.Lock()
+	if shard.dataMap[entry.cacheKey] != entry {
+		// Already deleted
+		shard.lock.Unlock()
+		return
+	}
+	entry.size += uint64(n)
+	shard.tracks[entry.cacheKey.TrackKey].bytes += uint64(n)
+	moqtObjs.bytes.Add(uint64(n))
+
+	// Evict from this shard first
+	moqtObjs.enforceBudgetLocked(shard, entry.cacheKey.TrackKey)
+	shard.lock.Unlock()
+
+	if moqtObjs.overBudget() {
+		// Then from the rest, one shard locked at a time
+		for _, otherShard := range moqtObjs.shards {
+			if otherShard == shard {
+				continue
+			}
+			otherShard.lock.Lock()
+			moqtObjs.evictFrom(otherShard, otherShard.lru, moqtObjs.overBudget)
+			otherShard.lock.Unlock()
+
+			if !moqtObjs.overBudget() {
+				break
+			}
+		}
+	}
+	if !moqtObjs.overBudget() {
+		if moqtObjs.overBudgetLogged.Load() {
+			moqtObjs.overBudgetLogged.Store(false)
+		}
+	} else if moqtObjs.overBudgetLogged.CompareAndSwap(false, true) {
+		// Only once, every write checks it
+		log.Warn(fmt.Sprintf("MOQ cache over budget, the least recently used objects are in use. Bytes: %d", moqtObjs.BytesHeld()))
+	}
+}
+
+func (moqtObjs *MoqMessageObjects) overBudget() bool {
+	return moqtObjs.maxBytes > 0 && moqtObjs.bytes.Load() > moqtObjs.maxBytes
+}
+
+// Evicts least recently used objects until the shard is under budget, objects
+// still being written or read are never evicted
+func (moqtObjs *MoqMessageObjects) enforceBudgetLocked(shard *cacheShard, trackKey moqobject.TrackKey) {
+	if track := shard.tracks[trackKey]; moqtObjs.maxTrackBytes > 0 && track.bytes > moqtObjs.maxTrackBytes {
+		moqtObjs.evictFrom(shard, track.lru, func() bool { return track.bytes > moqtObjs.maxTrackBytes })
+	}
+	if moqtObjs.overBudget() {
+		moqtObjs.evictFrom(shard, shard.lru, moqtObjs.overBudget)
+	}
+}
+
+// Stops at the first object in use, so writes do NOT walk the whole LRU when everything is in use
+// (the least recently used objects are the first ones to be released)
+func (moqtObjs *MoqMessageObjects) evictFrom(shard *cacheShard, lru *list.List, overBudget func() bool) {
+	elem := lru.Back()
+	for elem != nil && overBudget() {
+		prev := elem.Prev()
+		entry := elem.Value.(*cacheEntry)
+		if entry.inUse() {
+			return
+		}
+		moqtObjs.deleteLocked(shard, entry)
+		log.Info(fmt.Sprintf("EVICTED MOQ object over budget: %s (%d bytes)", entry.cacheKey, entry.size))
+		elem = prev
+	}
+}
+
+// Removes the entry, moves it to the disk tier (if enabled) and releases the cache references
+func (moqtObjs *MoqMessageObjects) deleteLocked(shard *cacheShard, entry *cacheEntry) {
+	delete(shard.dataMap, entry.cacheKey)
+
+	shard.lru.Remove(entry.lruElem)
+	shard.expiry.remove(entry)
+	track := shard.tracks[entry.cacheKey.TrackKey]
+	track.lru.Remove(entry.trackLruElem)
+	track.remove(entry.cacheKey)
+
+	moqtObjs.bytes.Add(-entry.size)
+	track.bytes -= entry.size
+	if track.lru.Len() <= 0 {
+		delete(shard.tracks, entry.cacheKey.TrackKey)
+	}
+
+	moqtObjs.spill(entry)
+	for _, obj := range entry.objs {
+		obj.Release()
+	}
+}
+
+func (entry *cacheEntry) inUse() bool {
+	for _, obj := range entry.objs {
+		if obj.InUse() {
+			return true
+		}
+	}
+	return false
 }
 
 // Housekeeping
@@ -127,54 +416,109 @@ func (moqtObjs *MoqMessageObjects) stopCleanUp() {
 	log.Info("Stopped clean up thread")
 }
 
+// Moves an entry removed from memory to the disk tier (if enabled), before the cache releases it
+func (moqtObjs *MoqMessageObjects) spill(entry *cacheEntry) {
+	if moqtObjs.disk != nil {
+		moqtObjs.disk.spill(entry.cacheKey, entry.objs)
+	}
+}
+
 func (moqtObjs *MoqMessageObjects) runCleanupEvery(periodMs uint64, cleanUpChannelBidi chan bool) {
-	timeCh := time.NewTicker(time.Millisecond * time.Duration(periodMs))
+	period := time.Millisecond * time.Duration(periodMs)
+	expiryTimer := time.NewTimer(period)
+	timeCh := time.NewTicker(period)
 	exit := false
 
 	for !exit {
 		select {
+		// Wait for the next expiration
+		case tm := <-expiryTimer.C:
+			moqtObjs.cacheCleanUp(tm)
+			expiryTimer.Reset(moqtObjs.nextCleanUpIn(period))
+
 		// Wait for the next tick
 		case tm := <-timeCh.C:
-			moqtObjs.cacheCleanUp(tm)
+			if moqtObjs.disk != nil {
+				moqtObjs.disk.cleanUp(tm)
+			}
 
 		case <-cleanUpChannelBidi:
 			exit = true
 		}
 	}
+	expiryTimer.Stop()
+	timeCh.Stop()
+
 	// Indicates finished
 	cleanUpChannelBidi <- true
 
 	log.Info("Exited clean up thread")
 }
 
-func (moqtObjs *MoqMessageObjects) cacheCleanUp(now time.Time) {
-	objectsToDel := map[string]*moqobject.MoqObject{}
-
-	// TODO: This is a brute force approach, optimization recommended
-
-	moqtObjs.mapLock.Lock()
-	defer moqtObjs.mapLock.Unlock()
+// Time to wait until the next expiration, between EXPIRY_MIN_WAIT_MS and period
+func (moqtObjs *MoqMessageObjects) nextCleanUpIn(period time.Duration) time.Duration {
+	wait := period
+	for _, shard := range moqtObjs.shards {
+		shard.lock.RLock()
+		next := shard.expiry.next()
+		shard.lock.RUnlock()
 
-	numStartElements := len(moqtObjs.dataMap)
+		if !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+	}
+	if wait < time.Millisecond*EXPIRY_MIN_WAIT_MS {
+		wait = time.Millisecond * EXPIRY_MIN_WAIT_MS
+	}
+	return wait
+}
 
-	// Check for expired files
-	for key, objs := range moqtObjs.dataMap {
-		for _, obj := range objs {
-			if obj.MaxAgeS >= 0 && obj.GetEof() {
-				if obj.ReceivedAt.Add(time.Second * time.Duration(obj.MaxAgeS)).Before(now) {
-					objectsToDel[key] = obj
-				}
+// Removes expired objects in small batches, so ingest and delivery are only blocked for one batch
+func (moqtObjs *MoqMessageObjects) cacheCleanUp(now time.Time) {
+	numDeleted := 0
+	for _, shard := range moqtObjs.shards {
+		for {
+			numBatchDeleted, pending := moqtObjs.cacheCleanUpBatch(shard, now)
+			numDeleted += numBatchDeleted
+			if !pending {
+				break
 			}
 		}
 	}
-	// Delete expired files
-	for keyToDel := range objectsToDel {
-		// Delete from array
-		delete(moqtObjs.dataMap, keyToDel)
-		log.Info("CLEANUP MOQ object expired, deleted: ", keyToDel)
+
+	if numDeleted > 0 {
+		log.Info(fmt.Sprintf("Finished cleanup MOQ objects round expired. Deleted: %d, elements: %d, bytes held: %d", numDeleted, moqtObjs.numElements(), moqtObjs.BytesHeld()))
+	}
+}
+
+func (moqtObjs *MoqMessageObjects) cacheCleanUpBatch(shard *cacheShard, now time.Time) (numDeleted int, pending bool) {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	for i := 0; i < EXPIRY_BATCH_SIZE; i++ {
+		entry, found := shard.expiry.popExpired(now)
+		if !found {
+			return
+		}
+		if entry.inUse() {
+			// Still being written or read, try again later
+			shard.expiry.add(entry, now.Add(time.Millisecond*EXPIRY_IN_USE_RETRY_MS))
+			continue
+		}
+		moqtObjs.deleteLocked(shard, entry)
+		numDeleted++
+		log.Info("CLEANUP MOQ object expired, deleted: ", entry.cacheKey)
 	}
+	pending = true
 
-	numEndElements := len(moqtObjs.dataMap)
+	return
+}
 
-	log.Info(fmt.Sprintf("Finished cleanup MOQ objects round expired. Elements at start: %d, elements at end: %d", numStartElements, numEndElements))
+func (moqtObjs *MoqMessageObjects) numElements() (numElements int) {
+	for _, shard := range moqtObjs.shards {
+		shard.lock.RLock()
+		numElements += len(shard.dataMap)
+		shard.lock.RUnlock()
+	}
+	return
 }
@@ -0,0 +1,77 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqmessageobjects
+
+import (
+	"context"
+	"facebookexperimental/moq-go-server/moqobject"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const benchNumTracks = 256
+const benchSubscribersPerTrack = 4
+const benchObjectSize = 1200
+
+// Every parallel worker publishes objects on its own track and, after each
+// object, fetches it benchSubscribersPerTrack times as the fan-out would
+// Run: go test -run=^$ -bench=Cache -benchmem ./moqmessageobjects
+func benchmarkCache(b *testing.B, numShards int) {
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(log.InfoLevel)
+
+	objects := newWithShards(numShards, 0, 0, 0)
+	payload := make([]byte, benchObjectSize)
+	var nextTrack atomic.Uint64
+
+	b.SetBytes(benchObjectSize * (1 + benchSubscribersPerTrack))
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		trackKey := moqobject.NewTrackKey("bench", fmt.Sprintf("track%d", nextTrack.Add(1)%benchNumTracks))
+		buf := make([]byte, benchObjectSize)
+		group := uint64(0)
+
+		for pb.Next() {
+			cacheKey := moqobject.CacheKey{TrackKey: trackKey, Group: group}
+			moqObjs, err := objects.Create(cacheKey, moqobject.MoqObjectHeader{GroupSequence: group}, 60, []uint64{OPAQUE_BITRATE})
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, moqObj := range moqObjs {
+				moqObj.PayloadWrite(payload)
+				moqObj.SetEof()
+			}
+
+			for i := 0; i < benchSubscribersPerTrack; i++ {
+				moqObj, found := objects.Get(cacheKey, 0)
+				if !found {
+					b.Fatal("object not found: ", cacheKey)
+				}
+				reader := moqObj.NewReader(context.Background())
+				if _, err := io.ReadFull(reader, buf); err != nil {
+					b.Fatal(err)
+				}
+				reader.Close()
+				moqObj.Release()
+			}
+			group++
+		}
+	})
+}
+
+func BenchmarkCacheSingleShard(b *testing.B) {
+	benchmarkCache(b, 1)
+}
+
+func BenchmarkCacheSharded(b *testing.B) {
+	benchmarkCache(b, CACHE_NUM_SHARDS)
+}
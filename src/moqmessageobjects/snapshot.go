@@ -0,0 +1,222 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqmessageobjects
+
+import (
+	"encoding/json"
+	"errors"
+	"facebookexperimental/moq-go-server/moqobject"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const SNAPSHOT_INDEX_FILE_NAME = "index.json"
+
+// Object in the snapshot index, payloads are stored in one file per rendition
+type snapshotEntry struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Group     uint64 `json:"group"`
+	Object    uint64 `json:"object"`
+
+	TrackId   uint64 `json:"track_id"`
+	SendOrder uint64 `json:"send_order"`
+
+	ReceivedAt time.Time `json:"received_at"`
+	MaxAgeS    uint64    `json:"max_age_s"`
+	ExpiresAt  time.Time `json:"expires_at"`
+
+	Bitrates []uint64 `json:"bitrates"`
+}
+
+type snapshotObjs struct {
+	cacheKey  moqobject.CacheKey
+	objs      map[uint64]*moqobject.MoqObject
+	expiresAt time.Time
+}
+
+// Saves the completed (EOF) objects held in memory to dir (previous content is removed), to be
+// loaded by LoadSnapshot after a restart. Objects still being written are skipped
+func (moqtObjs *MoqMessageObjects) SaveSnapshot(dir string) (numSaved int, err error) {
+	var (
+		indexBuf []byte
+	)
+
+	if err = os.RemoveAll(dir); err != nil {
+		return
+	}
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return
+	}
+
+	index := []snapshotEntry{}
+	for _, shard := range moqtObjs.shards {
+		// Payloads are written without holding the shard lock
+		for _, snapshot := range collectCompleted(shard, time.Now()) {
+			if err == nil {
+				var entry snapshotEntry
+				if entry, err = writeSnapshotObjs(dir, snapshot); err == nil {
+					index = append(index, entry)
+				}
+			}
+			releaseAll(snapshot.objs)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	if indexBuf, err = json.Marshal(index); err != nil {
+		return
+	}
+	// Index is written last, a partial snapshot has no index
+	tmpPath := filepath.Join(dir, SNAPSHOT_INDEX_FILE_NAME+".tmp")
+	if err = os.WriteFile(tmpPath, indexBuf, 0644); err != nil {
+		return
+	}
+	if err = os.Rename(tmpPath, filepath.Join(dir, SNAPSHOT_INDEX_FILE_NAME)); err != nil {
+		return
+	}
+	numSaved = len(index)
+
+	log.Info(fmt.Sprintf("Saved cache snapshot at %s, objects: %d", dir, numSaved))
+
+	return
+}
+
+func collectCompleted(shard *cacheShard, now time.Time) (snapshots []snapshotObjs) {
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	for cacheKey, entry := range shard.dataMap {
+		if !entry.expiresAt.After(now) || !entry.completed() {
+			continue
+		}
+		// Keep the payload until it is written
+		for _, obj := range entry.objs {
+			obj.Retain()
+		}
+		snapshots = append(snapshots, snapshotObjs{cacheKey: cacheKey, objs: entry.objs, expiresAt: entry.expiresAt})
+	}
+	return
+}
+
+func (entry *cacheEntry) completed() bool {
+	if len(entry.objs) <= 0 {
+		return false
+	}
+	for _, obj := range entry.objs {
+		if !obj.GetEof() {
+			return false
+		}
+	}
+	return true
+}
+
+func writeSnapshotObjs(dir string, snapshot snapshotObjs) (entry snapshotEntry, err error) {
+	entry = snapshotEntry{Namespace: snapshot.cacheKey.Namespace, Name: snapshot.cacheKey.Name, Group: snapshot.cacheKey.Group, Object: snapshot.cacheKey.Object, ExpiresAt: snapshot.expiresAt}
+	for bitrate, obj := range snapshot.objs {
+		if _, err = writeObjectFile(objectFilePath(dir, snapshot.cacheKey, bitrate), obj); err != nil {
+			err = errors.New(fmt.Sprintf("Writing snapshot object %s (%d), err: %v", snapshot.cacheKey, bitrate, err))
+			return
+		}
+		entry.TrackId = obj.TrackId
+		entry.SendOrder = obj.SendOrder
+		entry.ReceivedAt = obj.ReceivedAt
+		entry.MaxAgeS = obj.MaxAgeS
+		entry.Bitrates = append(entry.Bitrates, bitrate)
+	}
+	return
+}
+
+// Loads a snapshot saved by SaveSnapshot keeping the remaining TTLs (expired objects are skipped),
+// then removes it so it is only loaded once. No snapshot in dir is NOT an error
+func (moqtObjs *MoqMessageObjects) LoadSnapshot(dir string) (numLoaded int, err error) {
+	var (
+		indexBuf []byte
+		index    []snapshotEntry
+	)
+
+	indexPath := filepath.Join(dir, SNAPSHOT_INDEX_FILE_NAME)
+	if indexBuf, err = os.ReadFile(indexPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+	if err = json.Unmarshal(indexBuf, &index); err != nil {
+		err = errors.New(fmt.Sprintf("Parsing %s, err: %v", indexPath, err))
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range index {
+		if !entry.ExpiresAt.After(now) {
+			continue
+		}
+		if errLoad := moqtObjs.loadSnapshotEntry(dir, entry); errLoad != nil {
+			log.Error(fmt.Sprintf("Loading snapshot object %s/%s/%d/%d. Err: %v", entry.Namespace, entry.Name, entry.Group, entry.Object, errLoad))
+			continue
+		}
+		numLoaded++
+	}
+
+	log.Info(fmt.Sprintf("Loaded cache snapshot from %s, objects: %d (saved: %d), bytes held: %d", dir, numLoaded, len(index), moqtObjs.BytesHeld()))
+
+	err = os.RemoveAll(dir)
+
+	return
+}
+
+func (moqtObjs *MoqMessageObjects) loadSnapshotEntry(dir string, snapshot snapshotEntry) (err error) {
+	var (
+		file *os.File
+	)
+
+	objHeader := moqobject.MoqObjectHeader{TrackId: snapshot.TrackId, GroupSequence: snapshot.Group, ObjectSequence: snapshot.Object, SendOrder: snapshot.SendOrder}
+	cacheKey := moqobject.NewCacheKey(moqobject.NewTrackKey(snapshot.Namespace, snapshot.Name), objHeader)
+	entry := &cacheEntry{cacheKey: cacheKey, objs: map[uint64]*moqobject.MoqObject{}, expiryPosition: newExpiryPosition()}
+
+	// Objects are read before adding them to the cache, they are complete once added
+	for _, bitrate := range snapshot.Bitrates {
+		obj := moqobject.New(objHeader, snapshot.MaxAgeS)
+		obj.ReceivedAt = snapshot.ReceivedAt
+		entry.objs[bitrate] = obj
+		if file, err = os.Open(objectFilePath(dir, cacheKey, bitrate)); err == nil {
+			_, err = obj.ReadFrom(file)
+			file.Close()
+		}
+		if err != nil {
+			releaseAll(entry.objs)
+			return
+		}
+		obj.SetEof()
+		entry.size += uint64(obj.Len())
+	}
+	if len(entry.objs) <= 0 {
+		return errors.New("No renditions")
+	}
+
+	shard := moqtObjs.shardFor(cacheKey.TrackKey)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	if _, found := shard.dataMap[cacheKey]; found {
+		releaseAll(entry.objs)
+		return errors.New("Already in the cache")
+	}
+	shard.insertLocked(entry, snapshot.ExpiresAt)
+	shard.tracks[cacheKey.TrackKey].bytes += entry.size
+	moqtObjs.bytes.Add(entry.size)
+	moqtObjs.enforceBudgetLocked(shard, cacheKey.TrackKey)
+
+	return
+}
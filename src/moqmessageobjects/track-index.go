@@ -0,0 +1,101 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqmessageobjects
+
+import (
+	"container/list"
+	"facebookexperimental/moq-go-server/moqobject"
+	"slices"
+)
+
+// Objects of a track held in memory
+type cacheTrack struct {
+	// LRU order of the track entries, front is the most recently used
+	lru *list.List
+
+	// Payload bytes held
+	bytes uint64
+
+	// Group sequences held, ascending
+	groups []uint64
+
+	// Object sequences held per group, ascending
+	objects map[uint64][]uint64
+}
+
+func newCacheTrack() *cacheTrack {
+	return &cacheTrack{lru: list.New(), objects: map[uint64][]uint64{}}
+}
+
+func (t *cacheTrack) add(cacheKey moqobject.CacheKey) {
+	groupObjects, found := t.objects[cacheKey.Group]
+	if !found {
+		t.groups = insertSorted(t.groups, cacheKey.Group)
+	}
+	t.objects[cacheKey.Group] = insertSorted(groupObjects, cacheKey.Object)
+}
+
+func (t *cacheTrack) remove(cacheKey moqobject.CacheKey) {
+	groupObjects := removeSorted(t.objects[cacheKey.Group], cacheKey.Object)
+	if len(groupObjects) > 0 {
+		t.objects[cacheKey.Group] = groupObjects
+		return
+	}
+	delete(t.objects, cacheKey.Group)
+	t.groups = removeSorted(t.groups, cacheKey.Group)
+}
+
+func (t *cacheTrack) latestGroup() (group uint64, found bool) {
+	if len(t.groups) <= 0 {
+		return
+	}
+	return t.groups[len(t.groups)-1], true
+}
+
+// First and last of the latest numGroups groups held
+func (t *cacheTrack) latestGroups(numGroups uint64) (startGroup uint64, endGroup uint64, found bool) {
+	if len(t.groups) <= 0 || numGroups <= 0 {
+		return
+	}
+	start := len(t.groups) - int(min(numGroups, uint64(len(t.groups))))
+	return t.groups[start], t.groups[len(t.groups)-1], true
+}
+
+// Keys from startGroup to endGroup (both included), in group / object order
+func (t *cacheTrack) keysInRange(trackKey moqobject.TrackKey, startGroup uint64, endGroup uint64) (cacheKeys []moqobject.CacheKey) {
+	start, _ := slices.BinarySearch(t.groups, startGroup)
+	for _, group := range t.groups[start:] {
+		if group > endGroup {
+			break
+		}
+		for _, object := range t.objects[group] {
+			cacheKeys = append(cacheKeys, moqobject.CacheKey{TrackKey: trackKey, Group: group, Object: object})
+		}
+	}
+	return
+}
+
+// Sequences mostly arrive in order, so it is usually an append
+func insertSorted(values []uint64, value uint64) []uint64 {
+	if len(values) <= 0 || values[len(values)-1] < value {
+		return append(values, value)
+	}
+	pos, found := slices.BinarySearch(values, value)
+	if found {
+		return values
+	}
+	return slices.Insert(values, pos, value)
+}
+
+// Sequences mostly expire in order, so it is usually the first one
+func removeSorted(values []uint64, value uint64) []uint64 {
+	pos, found := slices.BinarySearch(values, value)
+	if !found {
+		return values
+	}
+	return slices.Delete(values, pos, pos+1)
+}
@@ -0,0 +1,72 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqobject
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Track identity, namespaces and names can contain any character (including "/")
+type TrackKey struct {
+	Namespace string
+	Name      string
+}
+
+// Object identity
+type CacheKey struct {
+	TrackKey
+	Group  uint64
+	Object uint64
+}
+
+func NewTrackKey(trackNamespace string, trackName string) TrackKey {
+	return TrackKey{Namespace: trackNamespace, Name: trackName}
+}
+
+func NewCacheKey(trackKey TrackKey, objHeader MoqObjectHeader) CacheKey {
+	return CacheKey{TrackKey: trackKey, Group: objHeader.GroupSequence, Object: objHeader.ObjectSequence}
+}
+
+// Only for logs, it is NOT unique
+func (k TrackKey) String() string {
+	return fmt.Sprintf("%s/%s", k.Namespace, k.Name)
+}
+
+// Unique and unambiguous representation (lengths prefixed), used as file name source
+func (k TrackKey) Id() string {
+	return fmt.Sprintf("%d:%s%d:%s", len(k.Namespace), k.Namespace, len(k.Name), k.Name)
+}
+
+// Only for logs, it is NOT unique
+func (k CacheKey) String() string {
+	return fmt.Sprintf("%s/%d/%d", k.TrackKey.String(), k.Group, k.Object)
+}
+
+// Unique and unambiguous representation, used as file name source
+func (k CacheKey) Id() string {
+	return fmt.Sprintf("%s/%d/%d", k.TrackKey.Id(), k.Group, k.Object)
+}
+
+// Rendition tracks are named <track>@<bitrate>k (example: video@500k)
+func RenditionTrackName(trackName string, bitrate uint64) string {
+	return fmt.Sprintf("%s@%dk", trackName, bitrate)
+}
+
+// Splits a rendition track name, ok is false if name is NOT one
+func ParseRenditionTrackName(name string) (trackName string, bitrate uint64, ok bool) {
+	at := strings.LastIndex(name, "@")
+	if at <= 0 || !strings.HasSuffix(name, "k") {
+		return
+	}
+	bitrate, err := strconv.ParseUint(name[at+1:len(name)-1], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return name[:at], bitrate, true
+}
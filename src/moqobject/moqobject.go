@@ -7,12 +7,26 @@ LICENSE file in the root directory of this source tree.
 package moqobject
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
 	"time"
 )
 
+// Payload is stored in chunks of this size, taken from (and given back to) a pool
+const PAYLOAD_CHUNK_SIZE = 4096
+
+var chunkPool = sync.Pool{
+	New: func() any {
+		chunk := make([]byte, PAYLOAD_CHUNK_SIZE)
+		return &chunk
+	},
+}
+
+var errReleased = errors.New("Object payload already released")
+
 // Object header
 type MoqObjectHeader struct {
 	TrackId        uint64
@@ -27,14 +41,34 @@ type MoqObject struct {
 	ReceivedAt time.Time
 	MaxAgeS    uint64
 
-	// Mutable (protected)
-	buffer []byte
+	// Mutable (protected), payload chunks (only the last one can be partially filled)
+	chunks []*[]byte
+	size   int
 
 	// Mutable (protected)
 	eof bool
 
+	// Mutable (protected), set when the publisher fails, no more bytes will be added
+	err error
+
+	// Mutable (protected), the payload is a key chunk (LOC), set once its header is decoded
+	keyChunk bool
+
+	// Mutable (protected), number of open readers
+	readers int
+
+	// Mutable (protected), references to the payload (owner, Retain calls and open readers),
+	// chunks go back to the pool when it reaches 0
+	refs int
+
+	// Called (out of the lock) after every payload write, used for cache accounting
+	onWrite func(n int)
+
 	// Lock to protect mutable fields
 	lock *sync.RWMutex
+
+	// Signaled (on lock) every time there are new bytes, EOF or error
+	changed *sync.Cond
 }
 
 func (m *MoqObjectHeader) GetDebugStr() string {
@@ -44,12 +78,19 @@ func (m *MoqObjectHeader) GetDebugStr() string {
 // FileReader Defines a reader
 type moqMessageObjectReader struct {
 	offset int
+	closed bool
+
+	// Reader context, Read unblocks when it is done
+	ctx        context.Context
+	stopNotify func() bool
+
 	*MoqObject
 }
 
-// New message object
+// New message object, the caller owns the first reference
 func New(objHeader MoqObjectHeader, maxAgeS uint64) *MoqObject {
-	moqtObj := MoqObject{MoqObjectHeader: MoqObjectHeader{TrackId: objHeader.TrackId, GroupSequence: objHeader.GroupSequence, ObjectSequence: objHeader.ObjectSequence, SendOrder: objHeader.SendOrder}, ReceivedAt: time.Now(), MaxAgeS: maxAgeS, eof: false, buffer: []byte{}, lock: new(sync.RWMutex)}
+	moqtObj := MoqObject{MoqObjectHeader: MoqObjectHeader{TrackId: objHeader.TrackId, GroupSequence: objHeader.GroupSequence, ObjectSequence: objHeader.ObjectSequence, SendOrder: objHeader.SendOrder}, ReceivedAt: time.Now(), MaxAgeS: maxAgeS, eof: false, refs: 1, lock: new(sync.RWMutex)}
+	moqtObj.changed = sync.NewCond(moqtObj.lock)
 
 	return &moqtObj
 }
@@ -58,24 +99,138 @@ func (m *MoqObject) GetDebugStr() string {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	return fmt.Sprintf("%s, bytesRead: %d", m.MoqObjectHeader.GetDebugStr(), len(m.buffer))
+	return fmt.Sprintf("%s, bytesRead: %d", m.MoqObjectHeader.GetDebugStr(), m.size)
+}
+
+// Sets write callback, it needs to be called before the object is shared
+func (m *MoqObject) SetOnWrite(onWrite func(n int)) {
+	m.onWrite = onWrite
+}
+
+// Adds a reference to the payload, it needs to be released when done
+func (m *MoqObject) Retain() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.refs++
+}
+
+// Releases a reference, the payload chunks are reused after the last one
+func (m *MoqObject) Release() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.releaseLocked()
+}
+
+func (m *MoqObject) releaseLocked() {
+	m.refs--
+	if m.refs > 0 {
+		return
+	}
+	for _, chunk := range m.chunks {
+		chunkPool.Put(chunk)
+	}
+	m.chunks = nil
+}
+
+// Free space at the end of the payload, a new chunk is added if needed (protected)
+func (m *MoqObject) tailLocked() []byte {
+	if m.size >= len(m.chunks)*PAYLOAD_CHUNK_SIZE {
+		m.chunks = append(m.chunks, chunkPool.Get().(*[]byte))
+	}
+	return (*m.chunks[len(m.chunks)-1])[m.size%PAYLOAD_CHUNK_SIZE:]
 }
 
 // Write bytes
 func (m *MoqObject) PayloadWrite(p []byte) int {
 	m.lock.Lock()
-	defer m.lock.Unlock()
+	if m.refs <= 0 {
+		m.lock.Unlock()
+		return 0
+	}
+	written := 0
+	for written < len(p) {
+		n := copy(m.tailLocked(), p[written:])
+		m.size += n
+		written += n
+	}
+	m.changed.Broadcast()
+	m.lock.Unlock()
 
-	m.buffer = append(m.buffer, p...)
+	if m.onWrite != nil {
+		m.onWrite(len(p))
+	}
 	return len(p)
 }
 
+// Reads from reader until EOF, straight into the payload chunks (no intermediate buffer).
+// Single writer, bytes past size are not visible to readers so they are filled out of the lock
+func (m *MoqObject) ReadFrom(reader io.Reader) (total int64, err error) {
+	for {
+		m.lock.Lock()
+		if m.refs <= 0 {
+			m.lock.Unlock()
+			return total, errReleased
+		}
+		tail := m.tailLocked()
+		m.lock.Unlock()
+
+		n, errRead := reader.Read(tail)
+		if n > 0 {
+			m.lock.Lock()
+			m.size += n
+			m.changed.Broadcast()
+			m.lock.Unlock()
+
+			if m.onWrite != nil {
+				m.onWrite(n)
+			}
+			total += int64(n)
+		}
+		if errRead == io.EOF {
+			return
+		}
+		if errRead != nil {
+			return total, errRead
+		}
+	}
+}
+
 // NO more bytes will be added
 func (m *MoqObject) SetEof() {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	m.eof = true
+	m.changed.Broadcast()
+}
+
+// Aborts the object (publisher failed), readers get err after the bytes already written.
+// Readers block waiting for bytes, so every writer that gives up needs to call it
+func (m *MoqObject) SetError(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.eof && m.err == nil {
+		m.err = err
+		m.changed.Broadcast()
+	}
+}
+
+func (m *MoqObject) SetKeyChunk() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.keyChunk = true
+}
+
+// Key chunk, a rendition switch point (false if NOT known yet)
+func (m *MoqObject) IsKeyChunk() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.keyChunk
 }
 
 // Get EOF
@@ -86,33 +241,121 @@ func (m *MoqObject) GetEof() bool {
 	return m.eof
 }
 
-// Returns a new reader
-func (m *MoqObject) NewReader() io.Reader {
+// Object still being written or read
+func (m *MoqObject) InUse() bool {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	return &moqMessageObjectReader{
+	return (!m.eof && m.err == nil) || m.readers > 0
+}
+
+// Returns a new reader, it needs to be closed when done.
+// Read blocks until there are new bytes, EOF, error or ctx is done
+func (m *MoqObject) NewReader(ctx context.Context) io.ReadCloser {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.readers++
+	m.refs++
+
+	r := &moqMessageObjectReader{
 		offset:    0,
+		ctx:       ctx,
 		MoqObject: m,
 	}
+	r.stopNotify = noStopNotify
+	if ctx.Done() != nil {
+		r.stopNotify = context.AfterFunc(ctx, func() {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+
+			m.changed.Broadcast()
+		})
+	}
+
+	return r
 }
 
-// Read Reads bytes from object
-func (r *moqMessageObjectReader) Read(p []byte) (int, error) {
-	r.MoqObject.lock.RLock()
-	defer r.MoqObject.lock.RUnlock()
+// Used for contexts that can not be canceled
+func noStopNotify() bool {
+	return true
+}
 
-	if r.offset >= len(r.MoqObject.buffer) {
+// Waits for bytes after offset and returns them, without copying, up to the end of their chunk.
+// The chunk stays valid while the reader is open (it holds a reference)
+func (r *moqMessageObjectReader) next() ([]byte, error) {
+	r.MoqObject.lock.Lock()
+	defer r.MoqObject.lock.Unlock()
+
+	for r.offset >= r.MoqObject.size {
 		if r.MoqObject.eof {
-			return 0, io.EOF
+			return nil, io.EOF
+		}
+		if r.MoqObject.err != nil {
+			return nil, r.MoqObject.err
+		}
+		if r.ctx.Err() != nil {
+			return nil, r.ctx.Err()
 		}
-		return 0, nil
+		r.MoqObject.changed.Wait()
+	}
+	if r.closed || r.MoqObject.chunks == nil {
+		return nil, errReleased
+	}
+
+	chunk := *r.MoqObject.chunks[r.offset/PAYLOAD_CHUNK_SIZE]
+	end := min(PAYLOAD_CHUNK_SIZE, r.MoqObject.size-(r.offset/PAYLOAD_CHUNK_SIZE)*PAYLOAD_CHUNK_SIZE)
+	return chunk[r.offset%PAYLOAD_CHUNK_SIZE : end], nil
+}
+
+// Read Reads bytes from object
+func (r *moqMessageObjectReader) Read(p []byte) (int, error) {
+	block, err := r.next()
+	if err != nil {
+		return 0, err
 	}
-	n := copy(p, r.MoqObject.buffer[r.offset:])
+	n := copy(p, block)
 	r.offset += n
 	return n, nil
 }
 
+// WriteTo writes the payload to w straight from the chunks (used by io.Copy)
+func (r *moqMessageObjectReader) WriteTo(w io.Writer) (total int64, err error) {
+	for {
+		block, errNext := r.next()
+		if errNext == io.EOF {
+			return
+		}
+		if errNext != nil {
+			return total, errNext
+		}
+		n, errWrite := w.Write(block)
+		r.offset += n
+		total += int64(n)
+		if errWrite != nil {
+			return total, errWrite
+		}
+	}
+}
+
+// Close releases the reader
+func (r *moqMessageObjectReader) Close() error {
+	r.stopNotify()
+
+	r.MoqObject.lock.Lock()
+	defer r.MoqObject.lock.Unlock()
+
+	if !r.closed {
+		r.closed = true
+		r.MoqObject.readers--
+		r.MoqObject.releaseLocked()
+	}
+	return nil
+}
+
 func (m *MoqObject) Len() int {
-	return len(m.buffer)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.size
 }
@@ -0,0 +1,57 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqobject
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+// Run: go test -run=^$ -bench=. -benchmem ./moqobject
+
+const benchObjectSize = 64 * 1024
+const benchWriteSize = 1024
+const benchFanOut = 32
+
+// Ingest of one object (in benchWriteSize writes), chunks are reused after release
+func BenchmarkPayloadWrite(b *testing.B) {
+	payload := make([]byte, benchWriteSize)
+
+	b.ReportAllocs()
+	b.SetBytes(benchObjectSize)
+	for i := 0; i < b.N; i++ {
+		moqObj := New(MoqObjectHeader{}, 60)
+		for written := 0; written < benchObjectSize; written += benchWriteSize {
+			moqObj.PayloadWrite(payload)
+		}
+		moqObj.SetEof()
+		moqObj.Release()
+	}
+}
+
+// Sends one object to benchFanOut subscribers, as SendObject does (io.Copy)
+func BenchmarkFanOut(b *testing.B) {
+	payload := make([]byte, benchObjectSize)
+	moqObj := New(MoqObjectHeader{}, 60)
+	moqObj.PayloadWrite(payload)
+	moqObj.SetEof()
+	defer moqObj.Release()
+
+	b.ReportAllocs()
+	b.SetBytes(benchObjectSize * benchFanOut)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for s := 0; s < benchFanOut; s++ {
+			reader := moqObj.NewReader(context.Background())
+			if _, err := io.Copy(io.Discard, reader); err != nil {
+				b.Fatal(err)
+			}
+			reader.Close()
+		}
+	}
+}
@@ -0,0 +1,245 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqquota
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"facebookexperimental/moq-go-server/moqauth"
+	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqsession"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_TENANT_NAME = "default"
+
+// Limits per tenant, 0 means no limit (per session limits default to the moqsession MAX_*_PER_SESSION)
+type Limits struct {
+	MaxPublishers           uint64 `json:"max_publishers"`
+	MaxSubscribers          uint64 `json:"max_subscribers"`
+	MaxNamespacesPerSession uint64 `json:"max_namespaces_per_session"`
+	MaxTracksPerSession     uint64 `json:"max_tracks_per_session"`
+	MaxIngestKbps           uint64 `json:"max_ingest_kbps"`
+	MaxEgressKbps           uint64 `json:"max_egress_kbps"`
+}
+
+// Tenant identified by name (from auth), by token or by URL path prefix
+type TenantConfig struct {
+	Name         string   `json:"name"`
+	Tokens       []string `json:"tokens"`
+	PathPrefixes []string `json:"path_prefixes"`
+	Limits
+}
+
+// Quotas file
+// Example: {"tenants": [{"name": "teamA", "path_prefixes": ["/teamA"], "max_publishers": 4, "max_egress_kbps": 50000}], "default": {"max_subscribers": 100}}
+type Config struct {
+	Tenants []TenantConfig `json:"tenants"`
+	Default Limits         `json:"default"`
+}
+
+type Tenant struct {
+	Name string
+	Limits
+
+	// Mutable (protected)
+	publishers  uint64
+	subscribers uint64
+
+	ingest *bitrateLimiter
+	egress *bitrateLimiter
+
+	// Lock to protect mutable fields
+	lock *sync.Mutex
+}
+
+type MoqQuotas struct {
+	// In config order, first match wins
+	tenants []*Tenant
+
+	tenantConfigs []TenantConfig
+
+	defaultTenant *Tenant
+}
+
+// New Creates quotas with default limits only
+func New() *MoqQuotas {
+	return newFromConfig(Config{})
+}
+
+func NewFromFile(path string) (q *MoqQuotas, err error) {
+	var (
+		buf    []byte
+		config Config
+	)
+
+	if buf, err = os.ReadFile(path); err != nil {
+		return
+	}
+	if err = json.Unmarshal(buf, &config); err != nil {
+		err = errors.New(fmt.Sprintf("Parsing quotas file %s, err: %v", path, err))
+		return
+	}
+
+	q = newFromConfig(config)
+	return
+}
+
+func newFromConfig(config Config) *MoqQuotas {
+	q := MoqQuotas{defaultTenant: newTenant(DEFAULT_TENANT_NAME, config.Default)}
+
+	for _, tenantConfig := range config.Tenants {
+		q.tenants = append(q.tenants, newTenant(tenantConfig.Name, tenantConfig.Limits))
+		q.tenantConfigs = append(q.tenantConfigs, tenantConfig)
+	}
+
+	return &q
+}
+
+func newTenant(name string, limits Limits) *Tenant {
+	if limits.MaxNamespacesPerSession <= 0 {
+		limits.MaxNamespacesPerSession = moqsession.MAX_PUBLISH_NAMESPACES_PER_SESSION
+	}
+	if limits.MaxTracksPerSession <= 0 {
+		limits.MaxTracksPerSession = moqsession.MAX_SUBSCRIBE_TRACKS_PER_SESSION
+	}
+	return &Tenant{Name: name, Limits: limits, ingest: newBitrateLimiter(limits.MaxIngestKbps), egress: newBitrateLimiter(limits.MaxEgressKbps), lock: new(sync.Mutex)}
+}
+
+// Finds the tenant of a session, tenant from auth first, then token, then URL path
+func (q *MoqQuotas) Resolve(session moqauth.SessionInfo, authTenant string) *Tenant {
+	if authTenant != "" {
+		for _, tenant := range q.tenants {
+			if tenant.Name == authTenant {
+				return tenant
+			}
+		}
+	}
+
+	token := session.Token()
+	if token != "" {
+		for i, tenantConfig := range q.tenantConfigs {
+			for _, tenantToken := range tenantConfig.Tokens {
+				if subtle.ConstantTimeCompare([]byte(tenantToken), []byte(token)) == 1 {
+					return q.tenants[i]
+				}
+			}
+		}
+	}
+
+	for i, tenantConfig := range q.tenantConfigs {
+		for _, pathPrefix := range tenantConfig.PathPrefixes {
+			if strings.HasPrefix(session.Path, pathPrefix) {
+				return q.tenants[i]
+			}
+		}
+	}
+
+	return q.defaultTenant
+}
+
+func (t *Tenant) AcquireSession(role moqhelpers.MoqRole) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if role == moqhelpers.MoqRolePublisher {
+		if t.MaxPublishers > 0 && t.publishers >= t.MaxPublishers {
+			return errors.New(fmt.Sprintf("Max publishers reached for tenant %s (%d)", t.Name, t.publishers))
+		}
+		t.publishers++
+	} else if role == moqhelpers.MoqRoleSubscriber {
+		if t.MaxSubscribers > 0 && t.subscribers >= t.MaxSubscribers {
+			return errors.New(fmt.Sprintf("Max subscribers reached for tenant %s (%d)", t.Name, t.subscribers))
+		}
+		t.subscribers++
+	}
+	return nil
+}
+
+func (t *Tenant) ReleaseSession(role moqhelpers.MoqRole) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if role == moqhelpers.MoqRolePublisher && t.publishers > 0 {
+		t.publishers--
+	} else if role == moqhelpers.MoqRoleSubscriber && t.subscribers > 0 {
+		t.subscribers--
+	}
+}
+
+// Aggregated ingest bitrate is under the limit
+func (t *Tenant) IngestAllowed() bool {
+	return t.ingest.allowed()
+}
+
+// Accounts received bytes
+func (t *Tenant) ConsumeIngest(size int) {
+	t.ingest.consume(size)
+}
+
+// Aggregated egress bitrate is under the limit
+func (t *Tenant) EgressAllowed() bool {
+	return t.egress.allowed()
+}
+
+// Accounts sent bytes
+func (t *Tenant) ConsumeEgress(size int) {
+	t.egress.consume(size)
+}
+
+// Token bucket (1s burst) that lets the current object finish and charges it afterwards
+type bitrateLimiter struct {
+	// Bytes per second (0 = no limit)
+	rate float64
+
+	// Mutable (protected)
+	tokens float64
+	last   time.Time
+
+	// Lock to protect mutable fields
+	lock *sync.Mutex
+}
+
+func newBitrateLimiter(kbps uint64) *bitrateLimiter {
+	rate := float64(kbps) * 1000 / 8
+	return &bitrateLimiter{rate: rate, tokens: rate, last: time.Now(), lock: new(sync.Mutex)}
+}
+
+func (l *bitrateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+}
+
+func (l *bitrateLimiter) allowed() bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.refill(time.Now())
+	return l.tokens > 0
+}
+
+func (l *bitrateLimiter) consume(size int) {
+	if l.rate <= 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.refill(time.Now())
+	l.tokens -= float64(size)
+}
@@ -9,10 +9,14 @@ package moqsession
 import (
 	"errors"
 	"facebookexperimental/moq-go-server/awt"
+	"facebookexperimental/moq-go-server/moqabr"
 	"facebookexperimental/moq-go-server/moqhelpers"
+	"facebookexperimental/moq-go-server/moqobject"
 	"fmt"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,6 +24,28 @@ const MAX_PUBLISH_NAMESPACES_PER_SESSION = 256
 const MAX_SUBSCRIBE_TRACKS_PER_SESSION = 256
 const SUBSCRIBER_INTERNAL_QUEUE_SIZE = 1024 * 1024
 
+// Track of every namespace answered by the relay with the stats of the subscriber session
+const STATS_TRACK_NAME = ".stats"
+
+// Rendition sent on a subscription
+type TrackStats struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Bitrate   uint64 `json:"bitrate"`
+	// Rendition track (bitrate NOT chosen by the ABR policy)
+	Fixed bool `json:"fixed,omitempty"`
+}
+
+// Stats track payload (JSON), one per group
+type StatsReport struct {
+	TimeMs int64 `json:"time_ms"`
+	// In kbps
+	Etp        uint64       `json:"etp"`
+	RttMs      float64      `json:"rtt_ms"`
+	QueueDepth int          `json:"queue_depth"`
+	Tracks     []TrackStats `json:"tracks"`
+}
+
 type moqNamespaceInfo struct {
 	AuthInfo       string
 	trackNamespace string
@@ -30,6 +56,34 @@ type MoqSubscribeChannelMessage struct {
 	stop bool
 }
 
+type MoqObjectChannelMessage struct {
+	delivery ObjectDelivery
+	stop     bool
+}
+
+// Track a subscription gets its objects from (the one subscribed upstream)
+type SubscriptionSource struct {
+	moqobject.TrackKey
+	// Rendition tracks always get this bitrate, the rest get one chosen by the ABR policy
+	Bitrate      uint64
+	FixedBitrate bool
+	// Nil means the session one
+	ABR moqabr.ABRPolicy
+}
+
+// Object to send on a subscription
+type ObjectDelivery struct {
+	CacheKey moqobject.CacheKey
+	// Subscribed track and its track id
+	Track        moqobject.TrackKey
+	TrackId      uint64
+	Bitrate      uint64
+	FixedBitrate bool
+	ABR          moqabr.ABRPolicy
+	// Generated by the relay for this session only (NOT in the cache), the delivery owns a reference
+	Object *moqobject.MoqObject
+}
+
 type noOp struct{}
 
 type MoqSubscribeResponseChannelMessage struct {
@@ -40,9 +94,37 @@ type MoqSubscribeResponseChannelMessage struct {
 
 type MoqMessageSubscribeExtended struct {
 	moqhelpers.MoqMessageSubscribe
+	source SubscriptionSource
+	// Assigned by the relay, unique in the session
 	trackId   uint64
 	expires   uint64
 	validated bool
+
+	// Zero means the subscription never expires
+	expiresAt   time.Time
+	expiryTimer *time.Timer
+
+	// Objects sent from the cache when subscribed, NOT sent again when notified
+	caughtUp map[moqobject.CacheKey]bool
+}
+
+// Rendition of the current (and previous) group of a subscription
+type renditionPin struct {
+	group       uint64
+	bitrate     uint64
+	prevGroup   uint64
+	prevBitrate uint64
+}
+
+func (subscribeExt *MoqMessageSubscribeExtended) isExpired(now time.Time) bool {
+	return !subscribeExt.expiresAt.IsZero() && !now.Before(subscribeExt.expiresAt)
+}
+
+func (subscribeExt *MoqMessageSubscribeExtended) stopExpiryTimer() {
+	if subscribeExt.expiryTimer != nil {
+		subscribeExt.expiryTimer.Stop()
+		subscribeExt.expiryTimer = nil
+	}
 }
 
 type MoqSession struct {
@@ -56,6 +138,10 @@ type MoqSession struct {
 	// Role
 	Role moqhelpers.MoqRole
 
+	// Limits
+	maxPublishNamespaces uint64
+	maxSubscribeTracks   uint64
+
 	// Data for publishers or both
 	// Namespaces, trackId -> trackName
 	namespaces map[string]map[uint64]string
@@ -68,28 +154,29 @@ type MoqSession struct {
 
 	// Data for subscribers or both
 	// Track info
-	tracks map[string]MoqMessageSubscribeExtended
+	tracks map[moqobject.TrackKey]MoqMessageSubscribeExtended
+	// Source track -> subscribed tracks
+	sources     map[moqobject.TrackKey]map[moqobject.TrackKey]bool
+	nextTrackId uint64
 	// Channel notify new objects
-	channelObject chan string
+	channelObject chan MoqObjectChannelMessage
 
 	// AWT extension
-	// path to qlog file
-	qlog awt.Qlog
-	// send timestamps
-	from, to time.Duration
-	// most recent etp
-	etp uint64
+	// stats of the QUIC connection (nil for sessions without one)
+	stats *awt.ConnectionStats
+	// default ABR policy of the subscriptions
+	abr moqabr.ABRPolicy
+	// trackId -> rendition pinned for the current group
+	renditions map[uint64]renditionPin
+	// objects being sent
+	objectsInFlight atomic.Int64
 
 	lock *sync.RWMutex
 }
 
-func New(uniqueName string, version moqhelpers.MoqVersion, role moqhelpers.MoqRole, qlogPath string) *MoqSession {
-	var (
-		qlog awt.Qlog
-	)
-
-	// should error check here, but will assume success here
-	qlog, _ = awt.NewQlog(qlogPath)
+func New(uniqueName string, version moqhelpers.MoqVersion, role moqhelpers.MoqRole, stats *awt.ConnectionStats) *MoqSession {
+	// The default one is always valid
+	abr, _ := moqabr.New(moqabr.DEFAULT_POLICY)
 
 	now := time.Now()
 	s := MoqSession{
@@ -97,22 +184,47 @@ func New(uniqueName string, version moqhelpers.MoqVersion, role moqhelpers.MoqRo
 		CreatedAt:                now,
 		Version:                  version,
 		Role:                     role,
+		maxPublishNamespaces:     MAX_PUBLISH_NAMESPACES_PER_SESSION,
+		maxSubscribeTracks:       MAX_SUBSCRIBE_TRACKS_PER_SESSION,
 		namespaces:               map[string]map[uint64]string{},
-		tracks:                   map[string]MoqMessageSubscribeExtended{},
-		channelObject:            make(chan string, SUBSCRIBER_INTERNAL_QUEUE_SIZE),
+		tracks:                   map[moqobject.TrackKey]MoqMessageSubscribeExtended{},
+		sources:                  map[moqobject.TrackKey]map[moqobject.TrackKey]bool{},
+		channelObject:            make(chan MoqObjectChannelMessage, SUBSCRIBER_INTERNAL_QUEUE_SIZE),
 		channelSubscribe:         make(chan MoqSubscribeChannelMessage, SUBSCRIBER_INTERNAL_QUEUE_SIZE),
 		channelSubscribeResponse: make(chan MoqSubscribeResponseChannelMessage, SUBSCRIBER_INTERNAL_QUEUE_SIZE), lock: new(sync.RWMutex),
-		qlog: qlog,
+		stats:      stats,
+		abr:        abr,
+		renditions: map[uint64]renditionPin{},
 	}
 
 	return &s
 }
 
+// Overrides the default ABR policy
+func (s *MoqSession) SetABRPolicy(abr moqabr.ABRPolicy) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.abr = abr
+}
+
+// Overrides the default per session limits
+func (s *MoqSession) SetLimits(maxPublishNamespaces uint64, maxSubscribeTracks uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.maxPublishNamespaces = maxPublishNamespaces
+	s.maxSubscribeTracks = maxSubscribeTracks
+}
+
 func (s *MoqSession) AddTrackNamespace(announce moqhelpers.MoqMessageAnnounce) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	if s.Role == moqhelpers.MoqRolePublisher && len(s.namespaces) > MAX_PUBLISH_NAMESPACES_PER_SESSION {
+	if _, found := s.namespaces[announce.TrackNamespace]; found {
+		return nil
+	}
+	if s.Role == moqhelpers.MoqRolePublisher && uint64(len(s.namespaces)) >= s.maxPublishNamespaces {
 		return errors.New("Max publish namespaces per session reached, can NOT add a new track")
 	}
 	s.namespaces[announce.TrackNamespace] = map[uint64]string{}
@@ -171,81 +283,263 @@ func (s *MoqSession) GetTrackInfo(trackId uint64) (found bool, trackNamespace st
 	return
 }
 
-func (s *MoqSession) NeedsToBeDForwarded(cacheKey string) bool {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
+// Adds a new subscription or renews one. New subscriptions are caught up with the objects recent returns for
+// their source (nil means none), NOT delivered again when notified. Returns how many were queued
+func (s *MoqSession) AddSubscribeRequest(subscribe moqhelpers.MoqMessageSubscribe, source SubscriptionSource, recent func(source moqobject.TrackKey) []moqobject.CacheKey) (numCaughtUp int, err error) {
+	var catchUp []ObjectDelivery
+	if catchUp, err = s.addSubscribeRequest(subscribe, source, recent); err != nil {
+		return
+	}
 
-	// Cachekey example: simplechat/foo/1/0 [trackNamespace/trackName/Group/Obj]
+	// Outside the lock, the queue can be full and its reader needs the lock (ChooseRendition)
+	for _, delivery := range catchUp {
+		s.channelObject <- MoqObjectChannelMessage{delivery, false}
+	}
+	return len(catchUp), nil
+}
 
-	cacheKeyItems := strings.Split(cacheKey, "/")
-	if len(cacheKeyItems) >= 2 {
-		cacheKeyTrackNamespace := cacheKeyItems[0]
-		cacheKeyTrackName := cacheKeyItems[1]
-		for k := range s.tracks {
-			// k [trackNamespace/trackName]
-			if k == cacheKeyTrackNamespace+"/"+cacheKeyTrackName {
-				return true
+func (s *MoqSession) addSubscribeRequest(subscribe moqhelpers.MoqMessageSubscribe, source SubscriptionSource, recent func(source moqobject.TrackKey) []moqobject.CacheKey) (catchUp []ObjectDelivery, err error) {
+	// Notifications wait for the lock, so an object is either in recent or notified after it
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	keyStr := moqobject.NewTrackKey(subscribe.TrackNamespace, subscribe.TrackName)
+	moqSubscribeExt, found := s.tracks[keyStr]
+	if found {
+		// Renewal, keep the current expiry and track id until the new SUBSCRIBE OK arrives
+		moqSubscribeExt.MoqMessageSubscribe = subscribe
+		moqSubscribeExt.validated = false
+		s.removeSourceLocked(moqSubscribeExt.source.TrackKey, keyStr)
+	} else {
+		if s.Role == moqhelpers.MoqRoleSubscriber && uint64(len(s.tracks)) >= s.maxSubscribeTracks {
+			return nil, errors.New("Max subscribe tracks per session reached, can NOT add a new track")
+		}
+		moqSubscribeExt = MoqMessageSubscribeExtended{MoqMessageSubscribe: subscribe, trackId: s.nextTrackId}
+		s.nextTrackId++
+		if recent != nil {
+			moqSubscribeExt.caughtUp = map[moqobject.CacheKey]bool{}
+			for _, cacheKey := range recent(source.TrackKey) {
+				moqSubscribeExt.caughtUp[cacheKey] = true
+				catchUp = append(catchUp, ObjectDelivery{CacheKey: cacheKey, Track: keyStr, TrackId: moqSubscribeExt.trackId, Bitrate: source.Bitrate, FixedBitrate: source.FixedBitrate, ABR: source.ABR})
 			}
 		}
 	}
-	return false
+	moqSubscribeExt.source = source
+	s.tracks[keyStr] = moqSubscribeExt
+	if _, found := s.sources[source.TrackKey]; !found {
+		s.sources[source.TrackKey] = map[moqobject.TrackKey]bool{}
+	}
+	s.sources[source.TrackKey][keyStr] = true
+	return
 }
 
-func (s *MoqSession) AddSubscribeRequest(subscribe moqhelpers.MoqMessageSubscribe) error {
+// Queues the keys NOT queued yet for a subscription (ex: answered from the cache without publishers), they are
+// NOT delivered again when notified. Returns how many were queued
+func (s *MoqSession) CatchUpTrackSubscription(trackKey moqobject.TrackKey, cacheKeys []moqobject.CacheKey) int {
+	var catchUp []ObjectDelivery
+
 	s.lock.Lock()
-	defer s.lock.Unlock()
+	if subscribeExt, found := s.tracks[trackKey]; found {
+		if subscribeExt.caughtUp == nil {
+			subscribeExt.caughtUp = map[moqobject.CacheKey]bool{}
+		}
+		for _, cacheKey := range cacheKeys {
+			if subscribeExt.caughtUp[cacheKey] {
+				continue
+			}
+			subscribeExt.caughtUp[cacheKey] = true
+			catchUp = append(catchUp, ObjectDelivery{CacheKey: cacheKey, Track: trackKey, TrackId: subscribeExt.trackId, Bitrate: subscribeExt.source.Bitrate, FixedBitrate: subscribeExt.source.FixedBitrate, ABR: subscribeExt.source.ABR})
+		}
+		s.tracks[trackKey] = subscribeExt
+	}
+	s.lock.Unlock()
 
-	if s.Role == moqhelpers.MoqRoleSubscriber && len(s.tracks) > MAX_SUBSCRIBE_TRACKS_PER_SESSION {
-		return errors.New("Max subscribe tracks per session reached, can NOT add a new track")
+	for _, delivery := range catchUp {
+		s.channelObject <- MoqObjectChannelMessage{delivery, false}
 	}
+	return len(catchUp)
+}
 
-	moqSubscribeExt := MoqMessageSubscribeExtended{subscribe, 0, 0, false}
-	s.tracks[subscribe.TrackNamespace+"/"+subscribe.TrackName] = moqSubscribeExt
-	return nil
+func (s *MoqSession) removeSourceLocked(source moqobject.TrackKey, trackKey moqobject.TrackKey) {
+	delete(s.sources[source], trackKey)
+	if len(s.sources[source]) <= 0 {
+		delete(s.sources, source)
+	}
+}
+
+func (s *MoqSession) deleteTrackLocked(trackKey moqobject.TrackKey) {
+	subscribeExt, found := s.tracks[trackKey]
+	if !found {
+		return
+	}
+	subscribeExt.stopExpiryTimer()
+	s.removeSourceLocked(subscribeExt.source.TrackKey, trackKey)
+	delete(s.renditions, subscribeExt.trackId)
+	delete(s.tracks, trackKey)
 }
 
-func (s *MoqSession) HasPendingTrackSubscriptionUpdate(trackNamespace string, trackName string, trackId uint64, expires uint64) (updated bool) {
+// Validates the pending (new or renewed) subscriptions that get objects from source, expires is in ms (0 = never).
+// Returns the SUBSCRIBE OK to send for each of them
+func (s *MoqSession) ValidatePendingTrackSubscriptions(source moqobject.TrackKey, expires uint64) (subscribeOks []moqhelpers.MoqMessageSubscribeOk) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	subscribeExt, found := s.tracks[trackNamespace+"/"+trackName]
-	if found {
-		if !subscribeExt.validated {
-			subscribeExt.validated = true
-			subscribeExt.trackId = trackId
-			subscribeExt.expires = expires
-
-			updated = true
+	for keyStr := range s.sources[source] {
+		subscribeExt := s.tracks[keyStr]
+		if subscribeExt.validated {
+			continue
+		}
+		subscribeExt.validated = true
+		subscribeExt.expires = expires
+
+		subscribeExt.stopExpiryTimer()
+		subscribeExt.expiresAt = time.Time{}
+		if expires > 0 {
+			trackKey := keyStr
+			expiresAt := time.Now().Add(time.Duration(expires) * time.Millisecond)
+			subscribeExt.expiresAt = expiresAt
+			subscribeExt.expiryTimer = time.AfterFunc(time.Until(expiresAt), func() {
+				s.expireTrackSubscription(trackKey, expiresAt)
+			})
 		}
+		s.tracks[keyStr] = subscribeExt
+
+		subscribeOks = append(subscribeOks, moqhelpers.MoqMessageSubscribeOk{TrackNamespace: keyStr.Namespace, TrackName: keyStr.Name, TrackId: subscribeExt.trackId, Expires: expires})
 	}
 	return
 }
 
-func (s *MoqSession) HasPendingTrackSubscriptionDelete(trackNamespace string, trackName string) (deleted bool) {
+func (s *MoqSession) expireTrackSubscription(trackKey moqobject.TrackKey, expiresAt time.Time) {
+	s.lock.Lock()
+
+	subscribeExt, found := s.tracks[trackKey]
+	if !found || !subscribeExt.expiresAt.Equal(expiresAt) {
+		// Deleted or renewed in the meantime
+		s.lock.Unlock()
+		return
+	}
+	// Also with a renewal in flight, the publisher may never answer it (a late SUBSCRIBE OK finds nothing pending)
+	s.deleteTrackLocked(trackKey)
+	s.lock.Unlock()
+
+	s.ForwardSubscribeResponseError(moqhelpers.MoqMessageSubscribeError{TrackNamespace: trackKey.Namespace, TrackName: trackKey.Name, ErrCode: moqhelpers.ErrorSubscribeExpired, ErrMsg: "Subscription expired"})
+}
+
+// Deletes the subscriptions that get objects from source, returns the deleted tracks
+func (s *MoqSession) DeleteTrackSubscriptions(source moqobject.TrackKey) (deleted []moqobject.TrackKey) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	keyStr := trackNamespace + "/" + trackName
-	_, found := s.tracks[keyStr]
-	if found {
-		delete(s.tracks, keyStr)
-		deleted = true
+	for keyStr := range s.sources[source] {
+		deleted = append(deleted, keyStr)
+	}
+	for _, keyStr := range deleted {
+		s.deleteTrackLocked(keyStr)
+	}
+	return
+}
+
+// Deletes a subscription (UNSUBSCRIBE)
+func (s *MoqSession) RemoveTrackSubscription(trackKey moqobject.TrackKey) (found bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, found = s.tracks[trackKey]; found {
+		s.deleteTrackLocked(trackKey)
 	}
 	return
 }
 
 func (s *MoqSession) StopThreads() {
-	s.ReceivedObject("")
+	s.stopExpiryTimers()
+	s.receivedObjectStop()
 	s.forwardSubscribeStop()
 	s.forwardSubscribeResponseStop()
 }
 
-func (s *MoqSession) ReceivedObject(cacheKey string) {
-	s.channelObject <- cacheKey
+func (s *MoqSession) stopExpiryTimers() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for keyStr, subscribeExt := range s.tracks {
+		subscribeExt.stopExpiryTimer()
+		s.tracks[keyStr] = subscribeExt
+	}
+}
+
+// Queues the object for every subscription that gets objects from its track
+func (s *MoqSession) ReceivedObject(cacheKey moqobject.CacheKey) {
+	deliveries := s.objectDeliveries(cacheKey)
+	for _, delivery := range deliveries {
+		s.channelObject <- MoqObjectChannelMessage{delivery, false}
+	}
 }
 
-func (s *MoqSession) GetNewObject() string {
-	return <-s.channelObject
+func (s *MoqSession) objectDeliveries(cacheKey moqobject.CacheKey) (deliveries []ObjectDelivery) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	now := time.Now()
+	for keyStr := range s.sources[cacheKey.TrackKey] {
+		subscribeExt := s.tracks[keyStr]
+		// Lapsed subscriptions do NOT get objects until renewed
+		if subscribeExt.isExpired(now) || subscribeExt.caughtUp[cacheKey] {
+			continue
+		}
+		deliveries = append(deliveries, ObjectDelivery{CacheKey: cacheKey, Track: keyStr, TrackId: subscribeExt.trackId, Bitrate: subscribeExt.source.Bitrate, FixedBitrate: subscribeExt.source.FixedBitrate, ABR: subscribeExt.source.ABR})
+	}
+	return
+}
+
+func IsStatsTrack(trackName string) bool {
+	return trackName == STATS_TRACK_NAME
+}
+
+// Queues an object generated by the relay for every subscription to trackName (any namespace), returns
+// how many got it. The caller keeps its reference
+func (s *MoqSession) DeliverRelayObject(trackName string, obj *moqobject.MoqObject) (delivered int) {
+	s.lock.RLock()
+	now := time.Now()
+	deliveries := []ObjectDelivery{}
+	for trackKey, subscribeExt := range s.tracks {
+		if trackKey.Name != trackName || !subscribeExt.validated || subscribeExt.isExpired(now) {
+			continue
+		}
+		obj.Retain()
+		cacheKey := moqobject.NewCacheKey(trackKey, obj.MoqObjectHeader)
+		deliveries = append(deliveries, ObjectDelivery{CacheKey: cacheKey, Track: trackKey, TrackId: subscribeExt.trackId, Object: obj})
+	}
+	s.lock.RUnlock()
+
+	for _, delivery := range deliveries {
+		s.channelObject <- MoqObjectChannelMessage{delivery, false}
+	}
+	return len(deliveries)
+}
+
+func (s *MoqSession) HasTrackSubscriptionTo(trackName string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for trackKey := range s.tracks {
+		if trackKey.Name == trackName {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MoqSession) GetNewObject() (delivery ObjectDelivery, stop bool) {
+	objectMsg := <-s.channelObject
+
+	delivery = objectMsg.delivery
+	stop = objectMsg.stop
+
+	return
+}
+
+func (s *MoqSession) receivedObjectStop() {
+	s.channelObject <- MoqObjectChannelMessage{ObjectDelivery{}, true}
 }
 
 func (s *MoqSession) ForwardSubscribe(subscribe moqhelpers.MoqMessageSubscribe) {
@@ -297,14 +591,103 @@ func (s *MoqSession) forwardSubscribeResponseStop() {
 	s.channelSubscribeResponse <- subscribeResponseStop
 }
 
-func (s *MoqSession) CalculateETP(streamID uint64, size int) (err error) {
-	if s.etp, err = s.qlog.FromStreamID(streamID, size); err != nil {
-		return
+// Rendition to send for the object, bitrates are the ones of its track (ascending). The rendition can only
+// change at a switch point (first object of a group or key chunk), then it is pinned for the rest of the group,
+// objects of other groups get the rendition they had (video is NOT decodable otherwise)
+func (s *MoqSession) ChooseRendition(delivery ObjectDelivery, bitrates []uint64, keyChunk bool) uint64 {
+	if delivery.FixedBitrate {
+		return delivery.Bitrate
+	}
+	group := delivery.CacheKey.Group
+	switchPoint := delivery.CacheKey.Object == 0 || keyChunk
+	in := moqabr.Input{QueueDepth: s.QueueDepth(), GroupStart: switchPoint}
+	if s.stats != nil {
+		in.ETPHistory = s.stats.ETPHistory()
+		in.RTT = s.stats.RTT()
 	}
 
-	return
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	pin, found := s.renditions[delivery.TrackId]
+	if found && group == pin.group {
+		return pin.bitrate
+	}
+	if found && group < pin.group {
+		// Late object
+		if group == pin.prevGroup {
+			return pin.prevBitrate
+		}
+		return pin.bitrate
+	}
+
+	bitrate := pin.bitrate
+	if !found || switchPoint {
+		abr := delivery.ABR
+		if abr == nil {
+			abr = s.abr
+		}
+		in.Current = pin.bitrate
+		bitrate = abr.Choose(bitrates, in)
+	}
+	// Unless unsubscribed in the meantime
+	if subscribeExt, found := s.tracks[delivery.Track]; found && subscribeExt.trackId == delivery.TrackId {
+		s.renditions[delivery.TrackId] = renditionPin{group: group, bitrate: bitrate, prevGroup: pin.group, prevBitrate: pin.bitrate}
+	}
+	return bitrate
+}
+
+// Objects waiting to be sent, queued or being sent
+func (s *MoqSession) QueueDepth() int {
+	return len(s.channelObject) + int(s.objectsInFlight.Load())
+}
+
+func (s *MoqSession) StartedSendingObject() {
+	s.objectsInFlight.Add(1)
+}
+
+func (s *MoqSession) FinishedSendingObject() {
+	s.objectsInFlight.Add(-1)
 }
 
+// Most recent ETP (kbps) of the connection, updated by its tracer as objects are sent
 func (s *MoqSession) GetETP() uint64 {
-	return s.etp
+	if s.stats == nil {
+		return 0
+	}
+	return s.stats.ETP()
+}
+
+// Current stats of the session, tracks are the validated subscriptions that already got a rendition
+func (s *MoqSession) StatsReport() StatsReport {
+	report := StatsReport{TimeMs: time.Now().UnixMilli(), QueueDepth: s.QueueDepth(), Tracks: []TrackStats{}}
+	if s.stats != nil {
+		report.Etp = s.stats.ETP()
+		report.RttMs = float64(s.stats.RTT()) / float64(time.Millisecond)
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for trackKey, subscribeExt := range s.tracks {
+		if !subscribeExt.validated {
+			continue
+		}
+		trackStats := TrackStats{Namespace: trackKey.Namespace, Name: trackKey.Name, Bitrate: subscribeExt.source.Bitrate, Fixed: subscribeExt.source.FixedBitrate}
+		if !trackStats.Fixed {
+			pin, found := s.renditions[subscribeExt.trackId]
+			if !found {
+				continue
+			}
+			trackStats.Bitrate = pin.bitrate
+		}
+		report.Tracks = append(report.Tracks, trackStats)
+	}
+	slices.SortFunc(report.Tracks, func(a TrackStats, b TrackStats) int {
+		if a.Namespace != b.Namespace {
+			return strings.Compare(a.Namespace, b.Namespace)
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return report
 }
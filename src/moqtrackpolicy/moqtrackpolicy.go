@@ -0,0 +1,220 @@
+/*
+Copyright (c) Meta Platforms, Inc. and affiliates.
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package moqtrackpolicy
+
+import (
+	"encoding/json"
+	"errors"
+	"facebookexperimental/moq-go-server/awt"
+	"facebookexperimental/moq-go-server/moqauth"
+	"facebookexperimental/moq-go-server/moqencoder"
+	"facebookexperimental/moq-go-server/moqmessageobjects"
+	"facebookexperimental/moq-go-server/moqobject"
+	"fmt"
+	"os"
+	"slices"
+)
+
+type Mode string
+
+const (
+	// Payload is forwarded untouched, the relay never decodes it (data, E2EE, non LOC packaging)
+	ModeOpaque Mode = "opaque"
+	// Payload is LOC, renditions are generated for it
+	ModeLoc Mode = "loc"
+)
+
+const DEFAULT_MODE = ModeLoc
+
+// Built in ladders
+const (
+	// awt.EncoderSettings
+	DEFAULT_LADDER_NAME = "default"
+	// Only the source, used by opaque tracks (and useful for audio / data)
+	SINGLE_LADDER_NAME = "single"
+)
+
+// Rule for tracks, namespace and track patterns support "*" at the end (see moqauth.MatchNamespace),
+// an empty track pattern matches any track. Empty encoder or ladder means the default one
+type Rule struct {
+	Namespace string `json:"namespace"`
+	Track     string `json:"track"`
+	Mode      Mode   `json:"mode"`
+	Encoder   string `json:"encoder"`
+	Ladder    string `json:"ladder"`
+}
+
+// Track policy file, ladders are added to the built in ones (DEFAULT_LADDER_NAME, SINGLE_LADDER_NAME)
+// Example: {"rules": [{"namespace": "e2ee/*", "mode": "opaque"}, {"namespace": "live/*", "track": "audio*", "mode": "loc", "ladder": "single"}, {"namespace": "live/*", "mode": "loc", "encoder": "external", "ladder": "hd"}],
+// "ladders": {"hd": [{"bitrate": 500, "resolution": "640x360", "max_rate": 500, "buf_size": 750}, {"bitrate": 3000, "resolution": "1920x1080", "passthrough": true}]}, "default": "loc", "default_encoder": "passthrough", "default_ladder": "default"}
+type Config struct {
+	Rules          []Rule                       `json:"rules"`
+	Ladders        map[string]awt.EncoderLadder `json:"ladders"`
+	Default        Mode                         `json:"default"`
+	DefaultEncoder string                       `json:"default_encoder"`
+	DefaultLadder  string                       `json:"default_ladder"`
+}
+
+type MoqTrackPolicy struct {
+	// In config order, first match wins
+	rules []Rule
+
+	defaultMode    Mode
+	defaultEncoder string
+	defaultLadder  string
+
+	// Encoders by name
+	encoders *moqencoder.Registry
+
+	// Ladders by name
+	ladders map[string]awt.EncoderLadder
+}
+
+// New Creates a policy where every track is DEFAULT_MODE, uses moqencoder.DEFAULT_ENCODER and the default ladder
+func New() *MoqTrackPolicy {
+	return &MoqTrackPolicy{defaultMode: DEFAULT_MODE, defaultEncoder: moqencoder.DEFAULT_ENCODER, defaultLadder: DEFAULT_LADDER_NAME, encoders: moqencoder.NewRegistry(), ladders: builtInLadders()}
+}
+
+func builtInLadders() map[string]awt.EncoderLadder {
+	return map[string]awt.EncoderLadder{
+		DEFAULT_LADDER_NAME: awt.EncoderSettings,
+		SINGLE_LADDER_NAME:  {{Bitrate: moqmessageobjects.OPAQUE_BITRATE, Passthrough: true}},
+	}
+}
+
+// NewFromFile Creates a policy from a file, every encoder used needs to be registered in encoders
+func NewFromFile(path string, encoders *moqencoder.Registry) (p *MoqTrackPolicy, err error) {
+	var (
+		buf    []byte
+		config Config
+	)
+
+	if buf, err = os.ReadFile(path); err != nil {
+		return
+	}
+	if err = json.Unmarshal(buf, &config); err != nil {
+		err = errors.New(fmt.Sprintf("Parsing track policy file %s, err: %v", path, err))
+		return
+	}
+
+	if config.Default == "" {
+		config.Default = DEFAULT_MODE
+	}
+	if config.DefaultEncoder == "" {
+		config.DefaultEncoder = moqencoder.DEFAULT_ENCODER
+	}
+	if config.DefaultLadder == "" {
+		config.DefaultLadder = DEFAULT_LADDER_NAME
+	}
+	if !config.Default.valid() {
+		err = errors.New(fmt.Sprintf("Invalid default mode %s in track policy file %s", config.Default, path))
+		return
+	}
+	for _, rule := range config.Rules {
+		if !rule.Mode.valid() {
+			err = errors.New(fmt.Sprintf("Invalid mode %s for namespace %s in track policy file %s", rule.Mode, rule.Namespace, path))
+			return
+		}
+	}
+
+	if _, err = encoders.Get(config.DefaultEncoder); err != nil {
+		err = errors.New(fmt.Sprintf("Invalid default encoder in track policy file %s, err: %v", path, err))
+		return
+	}
+	for _, rule := range config.Rules {
+		if rule.Encoder == "" {
+			continue
+		}
+		if _, err = encoders.Get(rule.Encoder); err != nil {
+			err = errors.New(fmt.Sprintf("Invalid encoder for namespace %s in track policy file %s, err: %v", rule.Namespace, path, err))
+			return
+		}
+	}
+
+	ladders := builtInLadders()
+	for name, ladder := range config.Ladders {
+		if _, found := ladders[name]; found {
+			err = errors.New(fmt.Sprintf("Ladder %s is built in, it can NOT be redefined in track policy file %s", name, path))
+			return
+		}
+		if err = ladder.Validate(); err != nil {
+			err = errors.New(fmt.Sprintf("Invalid ladder %s in track policy file %s, err: %v", name, path, err))
+			return
+		}
+		ladders[name] = ladder
+	}
+	if _, found := ladders[config.DefaultLadder]; !found {
+		err = errors.New(fmt.Sprintf("Invalid default ladder %s in track policy file %s", config.DefaultLadder, path))
+		return
+	}
+	for _, rule := range config.Rules {
+		if _, found := ladders[rule.Ladder]; rule.Ladder != "" && !found {
+			err = errors.New(fmt.Sprintf("Invalid ladder %s for namespace %s in track policy file %s", rule.Ladder, rule.Namespace, path))
+			return
+		}
+	}
+
+	p = &MoqTrackPolicy{rules: config.Rules, defaultMode: config.Default, defaultEncoder: config.DefaultEncoder, defaultLadder: config.DefaultLadder, encoders: encoders, ladders: ladders}
+	return
+}
+
+func (m Mode) valid() bool {
+	return m == ModeOpaque || m == ModeLoc
+}
+
+// Mode of a track
+func (p *MoqTrackPolicy) ModeFor(trackNamespace string, trackName string) Mode {
+	if rule, found := p.ruleFor(trackNamespace, trackName); found {
+		return rule.Mode
+	}
+	return p.defaultMode
+}
+
+// Encoder that generates the renditions of a track
+func (p *MoqTrackPolicy) EncoderFor(trackNamespace string, trackName string) moqencoder.Encoder {
+	name := p.defaultEncoder
+	if rule, found := p.ruleFor(trackNamespace, trackName); found && rule.Encoder != "" {
+		name = rule.Encoder
+	}
+	// Names are validated when the policy is created
+	encoder, _ := p.encoders.Get(name)
+	return encoder
+}
+
+func (p *MoqTrackPolicy) ruleFor(trackNamespace string, trackName string) (rule Rule, found bool) {
+	for _, rule = range p.rules {
+		if moqauth.MatchNamespace(rule.Namespace, trackNamespace) && (rule.Track == "" || moqauth.MatchNamespace(rule.Track, trackName)) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// Renditions of a track in mode, opaque tracks keep a single copy (the payload is never decoded)
+func (p *MoqTrackPolicy) LadderFor(mode Mode, trackNamespace string, trackName string) awt.EncoderLadder {
+	if mode == ModeOpaque {
+		return p.ladders[SINGLE_LADDER_NAME]
+	}
+	name := p.defaultLadder
+	if rule, found := p.ruleFor(trackNamespace, trackName); found && rule.Ladder != "" {
+		name = rule.Ladder
+	}
+	return p.ladders[name]
+}
+
+// Base track and bitrate of a rendition track (see moqobject.RenditionTrackName), found is false if trackName
+// is NOT a rendition of a track with several renditions, one of them of that bitrate
+func (p *MoqTrackPolicy) RenditionFor(trackNamespace string, trackName string) (baseName string, bitrate uint64, found bool) {
+	if baseName, bitrate, found = moqobject.ParseRenditionTrackName(trackName); !found {
+		return
+	}
+	ladder := p.LadderFor(p.ModeFor(trackNamespace, baseName), trackNamespace, baseName)
+	if len(ladder) <= 1 || !slices.Contains(ladder.Bitrates(), bitrate) {
+		return "", 0, false
+	}
+	return
+}